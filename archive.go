@@ -0,0 +1,508 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// An extractor reads one kind of archive, handing each entry to the extraction to be written out
+type extractor interface {
+	extract(archive *os.File, e *extraction) error
+}
+
+// archiveFormat identifies an archive by the magic bytes at a fixed offset
+type archiveFormat struct {
+	name      string
+	offset    int
+	magic     []byte
+	extractor extractor
+}
+
+var archiveFormats = []archiveFormat{
+	{"gzip", 0, []byte{0x1f, 0x8b}, tarExtractor{gzipReader}},
+	{"xz", 0, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, tarExtractor{xzReader}},
+	{"bzip2", 0, []byte("BZh"), tarExtractor{bzip2Reader}},
+	{"zstd", 0, []byte{0x28, 0xb5, 0x2f, 0xfd}, tarExtractor{zstdReader}},
+	{"zip", 0, []byte("PK\x03\x04"), zipExtractor{}},
+	{"tar", 257, []byte("ustar"), tarExtractor{}},
+}
+
+// detectArchiveFormat sniffs the start of a file for a known archive format
+func detectArchiveFormat(r io.Reader) (format archiveFormat, err error) {
+	header := make([]byte, 512)
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return format, err
+	}
+	header = header[:n]
+
+	for _, f := range archiveFormats {
+		if len(header) >= f.offset+len(f.magic) && bytes.Equal(header[f.offset:f.offset+len(f.magic)], f.magic) {
+			return f, nil
+		}
+	}
+
+	return format, fmt.Errorf("Unknown archive format")
+}
+
+// extractArchive works out what kind of archive a file is, then unpacks it into destination, stopping if ctx is cancelled
+// The returned directory is the archives top level directory if it has exactly one, otherwise destination itself
+func extractArchive(ctx context.Context, archivePath, destination string, stripComponents int) (outputDirectory string, err error) {
+	archive, err := os.Open(archivePath)
+	if err != nil {
+		return "", err
+	}
+	defer archive.Close()
+
+	format, err := detectArchiveFormat(archive)
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", archivePath, err)
+	}
+
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	e, err := newExtraction(ctx, destination, stripComponents)
+	if err != nil {
+		return "", err
+	}
+
+	err = format.extractor.extract(archive, e)
+	if err != nil {
+		return "", fmt.Errorf("Extracting %s (%s): %s", archivePath, format.name, err)
+	}
+
+	return e.finish()
+}
+
+// Decompressors are closed once extraction ends, which for zstd stops the decoders goroutines
+func gzipReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func xzReader(r io.Reader) (io.ReadCloser, error) {
+	x, err := xz.NewReader(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(x), nil
+}
+
+func bzip2Reader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(bzip2.NewReader(r)), nil
+}
+
+func zstdReader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}
+
+// tarExtractor handles tar archives, optionally wrapped in a compression format
+type tarExtractor struct {
+	decompress func(io.Reader) (io.ReadCloser, error)
+}
+
+func (t tarExtractor) extract(archive *os.File, e *extraction) (err error) {
+	var stream io.Reader = archive
+	if t.decompress != nil {
+		decompressed, err := t.decompress(archive)
+		if err != nil {
+			return err
+		}
+		defer decompressed.Close()
+		stream = decompressed
+	}
+
+	tarReader := tar.NewReader(stream)
+
+	for {
+		header, err := tarReader.Next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("Next() failed: %s", err)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = e.directory(header.Name, header.FileInfo().Mode(), header.ModTime)
+		case tar.TypeReg:
+			err = e.file(header.Name, header.FileInfo().Mode(), header.ModTime, tarReader)
+		case tar.TypeSymlink:
+			err = e.symlink(header.Name, header.Linkname)
+		case tar.TypeLink:
+			err = e.hardlink(header.Name, header.Linkname)
+		default:
+			// Devices, fifos and github's pax_global_header have no place in a source tree
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type zipExtractor struct{}
+
+func (zipExtractor) extract(archive *os.File, e *extraction) error {
+	info, err := archive.Stat()
+	if err != nil {
+		return err
+	}
+
+	zipReader, err := zip.NewReader(archive, info.Size())
+	if err != nil {
+		return err
+	}
+
+	for _, file := range zipReader.File {
+		mode := file.Mode()
+
+		switch {
+		case mode.IsDir():
+			err = e.directory(file.Name, mode, file.Modified)
+		case mode&fs.ModeSymlink != 0:
+			err = extractZipSymlink(file, e)
+		case mode.IsRegular():
+			err = extractZipFile(file, e)
+		default:
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func extractZipFile(file *zip.File, e *extraction) error {
+	in, err := file.Open()
+	if err != nil {
+		return fmt.Errorf("Open() failed: %s", err)
+	}
+	defer in.Close()
+
+	return e.file(file.Name, file.Mode(), file.Modified, in)
+}
+
+// Zips store the target of a symlink as the contents of the entry
+func extractZipSymlink(file *zip.File, e *extraction) error {
+	in, err := file.Open()
+	if err != nil {
+		return fmt.Errorf("Open() failed: %s", err)
+	}
+	defer in.Close()
+
+	target, err := ioutil.ReadAll(io.LimitReader(in, 4096))
+	if err != nil {
+		return err
+	}
+
+	return e.symlink(file.Name, string(target))
+}
+
+// extraction writes archive entries out below a root directory, refusing anything that would end up outside of it
+type extraction struct {
+	ctx             context.Context
+	root            string
+	stripComponents int
+
+	// First path component of every entry, and whether it was a file rather than a directory
+	topLevel map[string]bool
+
+	// Directory modification times are set once everything has been written into them
+	directoryTimes map[string]time.Time
+}
+
+func newExtraction(ctx context.Context, root string, stripComponents int) (*extraction, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+
+	// Symlinks are resolved when checking where things end up, so the root has to be too
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+
+	return &extraction{
+		ctx:             ctx,
+		root:            root,
+		stripComponents: stripComponents,
+		topLevel:        make(map[string]bool),
+		directoryTimes:  make(map[string]time.Time),
+	}, nil
+}
+
+// target maps the name of an archive entry to where it should be written, skip is set if strip components removes it entirely
+func (e *extraction) target(name string) (path string, components []string, skip bool, err error) {
+	// Every entry comes through here, so this is where a cancelled extraction stops
+	if err := e.ctx.Err(); err != nil {
+		return "", nil, false, err
+	}
+
+	name = strings.TrimPrefix(filepath.ToSlash(name), "./")
+
+	if strings.HasPrefix(name, "/") {
+		return "", nil, false, fmt.Errorf("Entry '%s' has an absolute path", name)
+	}
+
+	cleaned := pathpkg.Clean(name)
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", nil, false, fmt.Errorf("Entry '%s' would be written outside of %s", name, e.root)
+	}
+
+	components = strings.Split(cleaned, "/")
+	if cleaned == "." || len(components) <= e.stripComponents {
+		return "", nil, true, nil
+	}
+	components = components[e.stripComponents:]
+
+	path = filepath.Join(append([]string{e.root}, components...)...)
+
+	// Even with a clean name, writing through a symlink extracted earlier could end up somewhere else
+	if err := e.checkParents(path); err != nil {
+		return "", nil, false, fmt.Errorf("Entry '%s': %s", name, err)
+	}
+
+	return path, components, false, nil
+}
+
+func (e *extraction) within(path string) bool {
+	return path == e.root || strings.HasPrefix(path, e.root+string(filepath.Separator))
+}
+
+func (e *extraction) checkParents(path string) error {
+	relative, err := filepath.Rel(e.root, filepath.Dir(path))
+	if err != nil || relative == "." {
+		return err
+	}
+
+	current := e.root
+	for _, component := range strings.Split(relative, string(filepath.Separator)) {
+		current = filepath.Join(current, component)
+
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if info.Mode()&fs.ModeSymlink != 0 {
+			resolved, err := filepath.EvalSymlinks(current)
+			if err != nil {
+				return err
+			}
+
+			if !e.within(resolved) {
+				return fmt.Errorf("Parent directory %s links outside of %s", current, e.root)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (e *extraction) record(components []string, isFile bool) {
+	top := components[0]
+	e.topLevel[top] = e.topLevel[top] || (isFile && len(components) == 1)
+}
+
+// prepare makes sure the parent directory of path exists, and that nothing (especially not a symlink) is in the way
+func (e *extraction) prepare(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("Mkdir() failed: %s", err)
+	}
+
+	if info, err := os.Lstat(path); err == nil && !info.IsDir() {
+		return os.Remove(path)
+	}
+
+	return nil
+}
+
+func (e *extraction) directory(name string, mode fs.FileMode, modified time.Time) error {
+	path, components, skip, err := e.target(name)
+	if err != nil || skip {
+		return err
+	}
+	e.record(components, false)
+
+	if info, err := os.Lstat(path); err == nil && !info.IsDir() {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return fmt.Errorf("Mkdir() failed: %s", err)
+	}
+
+	// Always keep the directory writable by us, otherwise we cant extract into it
+	if err := os.Chmod(path, mode.Perm()|0700); err != nil {
+		return err
+	}
+
+	e.directoryTimes[path] = modified
+	return nil
+}
+
+func (e *extraction) file(name string, mode fs.FileMode, modified time.Time, contents io.Reader) error {
+	path, components, skip, err := e.target(name)
+	if err != nil || skip {
+		return err
+	}
+	e.record(components, true)
+
+	if err := e.prepare(path); err != nil {
+		return err
+	}
+
+	outFile, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return fmt.Errorf("Create() failed: %s", err)
+	}
+
+	_, err = io.Copy(outFile, contents)
+	outFile.Close()
+	if err != nil {
+		return fmt.Errorf("Copy() failed: %s", err)
+	}
+
+	// The umask may have removed executable bits from configure scripts and the like
+	if err := os.Chmod(path, mode.Perm()); err != nil {
+		return err
+	}
+
+	return os.Chtimes(path, modified, modified)
+}
+
+func (e *extraction) symlink(name, linkTarget string) error {
+	path, components, skip, err := e.target(name)
+	if err != nil || skip {
+		return err
+	}
+	e.record(components, true)
+
+	if err := e.prepare(path); err != nil {
+		return err
+	}
+
+	if err := e.checkLinkTarget(path, linkTarget); err != nil {
+		return fmt.Errorf("Symlink '%s' -> '%s' %s", name, linkTarget, err)
+	}
+
+	return os.Symlink(linkTarget, path)
+}
+
+// checkLinkTarget makes sure a symlink at path points inside the root. The target is followed from the directory the
+// link really is in, with any symlinks on the way there resolved, and can only go up (..) before it goes down. Going
+// down only passes through links that were checked the same way, so nothing extracted later can change where it points
+func (e *extraction) checkLinkTarget(path, linkTarget string) error {
+	if filepath.IsAbs(linkTarget) || strings.HasPrefix(filepath.ToSlash(linkTarget), "/") {
+		return fmt.Errorf("is absolute")
+	}
+
+	current, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+
+	descended := false
+	for _, component := range strings.Split(filepath.ToSlash(linkTarget), "/") {
+		switch component {
+		case "", ".":
+		case "..":
+			if descended {
+				return fmt.Errorf("goes back up after going down, which could go through a symlink")
+			}
+			current = filepath.Dir(current)
+		default:
+			descended = true
+		}
+	}
+
+	if !e.within(current) {
+		return fmt.Errorf("points outside of %s", e.root)
+	}
+
+	return nil
+}
+
+func (e *extraction) hardlink(name, linkTarget string) error {
+	path, components, skip, err := e.target(name)
+	if err != nil || skip {
+		return err
+	}
+
+	source, _, skipSource, err := e.target(linkTarget)
+	if err != nil {
+		return fmt.Errorf("Hardlink '%s': %s", name, err)
+	}
+
+	if skipSource {
+		return fmt.Errorf("Hardlink '%s' points at '%s' which was removed by strip components", name, linkTarget)
+	}
+	e.record(components, true)
+
+	if err := e.prepare(path); err != nil {
+		return err
+	}
+
+	return os.Link(source, path)
+}
+
+// finish applies directory modification times, and works out which directory holds the sources
+func (e *extraction) finish() (outputDirectory string, err error) {
+	for path, modified := range e.directoryTimes {
+		if err := os.Chtimes(path, modified, modified); err != nil {
+			return "", err
+		}
+	}
+
+	if len(e.topLevel) == 1 {
+		for top, isFile := range e.topLevel {
+			if !isFile {
+				return filepath.Join(e.root, top), nil
+			}
+		}
+	}
+
+	return e.root, nil
+}
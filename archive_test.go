@@ -0,0 +1,280 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// tarEntry is an entry of a tarball written by a test, a regular file unless typeflag says otherwise
+type tarEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+	contents string
+}
+
+func tarFile(name, contents string) tarEntry { return tarEntry{name: name, contents: contents} }
+func tarDir(name string) tarEntry            { return tarEntry{name: name, typeflag: tar.TypeDir} }
+func tarSymlink(name, target string) tarEntry {
+	return tarEntry{name: name, typeflag: tar.TypeSymlink, linkname: target}
+}
+func tarHardlink(name, target string) tarEntry {
+	return tarEntry{name: name, typeflag: tar.TypeLink, linkname: target}
+}
+
+func tarball(t *testing.T, entries ...tarEntry) []byte {
+	t.Helper()
+
+	b := bytes.Buffer{}
+	tw := tar.NewWriter(&b)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Typeflag: entry.typeflag, Linkname: entry.linkname, Mode: 0644}
+		switch entry.typeflag {
+		case tar.TypeDir:
+			header.Mode = 0755
+		case 0:
+			header.Typeflag = tar.TypeReg
+			header.Size = int64(len(entry.contents))
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return b.Bytes()
+}
+
+// writeTarball writes a gzipped tarball of the entries
+func writeTarball(t *testing.T, path string, entries ...tarEntry) {
+	t.Helper()
+
+	b := bytes.Buffer{}
+	gz := gzip.NewWriter(&b)
+	gz.Write(tarball(t, entries...))
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractionConfinement(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+		err     string // Part of the error, empty if it should extract
+		files   map[string]string
+	}{
+		{
+			name:    "parent directory",
+			entries: []tarEntry{tarFile("../evil", "x")},
+			err:     "outside of",
+		},
+		{
+			name:    "parent directory after a directory",
+			entries: []tarEntry{tarFile("pkg/../../evil", "x")},
+			err:     "outside of",
+		},
+		{
+			name:    "absolute path",
+			entries: []tarEntry{tarFile("/evil", "x")},
+			err:     "absolute path",
+		},
+		{
+			name:    "absolute symlink",
+			entries: []tarEntry{tarSymlink("pkg/etc", "/etc")},
+			err:     "is absolute",
+		},
+		{
+			name:    "symlink to a parent directory",
+			entries: []tarEntry{tarSymlink("pkg/up", "../..")},
+			err:     "points outside of",
+		},
+		{
+			name:    "symlink through a symlink to the root",
+			entries: []tarEntry{tarSymlink("d", "."), tarSymlink("x", "d/../..")},
+			err:     "goes back up",
+		},
+		{
+			name:    "symlink that only escapes once d is followed",
+			entries: []tarEntry{tarSymlink("d", "."), tarSymlink("x", "d/../evil")},
+			err:     "goes back up",
+		},
+		{
+			name:    "symlink placed by a symlinked directory",
+			entries: []tarEntry{tarDir("pkg/"), tarSymlink("pkg/root", ".."), tarSymlink("pkg/root/up", "..")},
+			err:     "points outside of",
+		},
+		{
+			name:    "file written through a symlink",
+			entries: []tarEntry{tarSymlink("pkg/out", "../../.."), tarFile("pkg/out/evil", "x")},
+			err:     "points outside of",
+		},
+		{
+			name:    "hardlink outside",
+			entries: []tarEntry{tarHardlink("pkg/passwd", "../../etc/passwd")},
+			err:     "outside of",
+		},
+		{
+			name: "symlinks that stay inside",
+			entries: []tarEntry{
+				tarFile("pkg/lib/libz.so.1", "lib"),
+				tarSymlink("pkg/lib/libz.so", "libz.so.1"),
+				tarSymlink("pkg/include/libz.so", "../lib/libz.so"),
+				tarSymlink("pkg/current", "lib"),
+				tarFile("pkg/current/written", "through"),
+				tarHardlink("pkg/lib/copy", "pkg/lib/libz.so.1"),
+			},
+			files: map[string]string{
+				"pkg/include/libz.so": "lib",
+				"pkg/lib/written":     "through",
+				"pkg/lib/copy":        "lib",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		root := t.TempDir()
+		destination := filepath.Join(root, "extract", "here")
+		archive := filepath.Join(root, "archive.tar.gz")
+		writeTarball(t, archive, test.entries...)
+
+		_, err := extractArchive(context.Background(), archive, destination, 0)
+		switch {
+		case len(test.err) == 0 && err != nil:
+			t.Errorf("%s: %s", test.name, err)
+		case len(test.err) != 0 && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: should fail with %q, got %v", test.name, test.err, err)
+		}
+
+		for name, contents := range test.files {
+			if b, err := ioutil.ReadFile(filepath.Join(destination, name)); err != nil || string(b) != contents {
+				t.Errorf("%s: %s is %q %v, want %q", test.name, name, b, err, contents)
+			}
+		}
+
+		// Nothing may turn up next to the destination, or anywhere above it
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err == nil && path != archive && !info.IsDir() && !strings.HasPrefix(path, destination+string(filepath.Separator)) {
+				t.Errorf("%s: %s was written outside of the destination", test.name, path)
+			}
+			return nil
+		})
+	}
+}
+
+// bzip2Tarball is pkg-1.0/README holding "readme", go can only read bzip2 so it was made with python's bz2
+const bzip2Tarball = "\x42\x5a\x68\x39\x31\x41\x59\x26\x53\x59\xb6\xc4\x6e\x2e\x00\x00\x93\xff\x80\xc9\x80\x00\x10\x40\x03\xf7" +
+	"\x80\x26\x02\x10\x40\x66\x8a\x5e\x00\x08\x08\x20\x00\x74\x12\x93\x50\x68\x00\x01\xa0\x68\x68\x24\xa4\x06\x9a\x00" +
+	"\xd0\x00\x03\xe7\xba\xba\x14\x49\x01\xac\x89\x21\x16\xd9\xd1\x73\x67\x0a\x64\x60\xe1\xa2\x10\xc0\x18\xb7\x1e\x44" +
+	"\x5e\xc0\x4c\x49\x05\x04\x36\x74\x42\x1a\x46\x68\x5c\xb6\xd7\x45\xad\x33\x9d\x5a\xb2\xae\x7a\xba\xc7\x37\x66\x26" +
+	"\xbe\x9c\xbf\x77\x9e\x1e\x3e\x0d\x19\x02\x04\x0a\xc4\x40\xfc\x5d\xc9\x14\xe1\x42\x42\xdb\x11\xb8\xb8"
+
+func TestExtractFormats(t *testing.T) {
+	plain := tarball(t, tarDir("pkg-1.0/"), tarFile("pkg-1.0/README", "readme"), tarSymlink("pkg-1.0/LINK", "README"))
+
+	compress := func(w io.WriteCloser, err error, b *bytes.Buffer) []byte {
+		t.Helper()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(plain)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return b.Bytes()
+	}
+
+	gz, zs, x := bytes.Buffer{}, bytes.Buffer{}, bytes.Buffer{}
+	zipped := bytes.Buffer{}
+	zw := zip.NewWriter(&zipped)
+	if w, err := zw.Create("pkg-1.0/README"); err != nil {
+		t.Fatal(err)
+	} else {
+		w.Write([]byte("readme"))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zstdWriter, zstdErr := zstd.NewWriter(&zs)
+	xzWriter, xzErr := xz.NewWriter(&x)
+
+	// Named without an extension, the format has to come from the contents
+	archives := []struct {
+		format   string
+		contents []byte
+	}{
+		{"tar", plain},
+		{"gzip", compress(gzip.NewWriter(&gz), nil, &gz)},
+		{"zstd", compress(zstdWriter, zstdErr, &zs)},
+		{"xz", compress(xzWriter, xzErr, &x)},
+		{"bzip2", []byte(bzip2Tarball)},
+		{"zip", zipped.Bytes()},
+	}
+
+	for _, archive := range archives {
+		root := t.TempDir()
+		path := filepath.Join(root, "archive")
+		if err := ioutil.WriteFile(path, archive.contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		output, err := extractArchive(context.Background(), path, filepath.Join(root, "out"), 0)
+		if err != nil {
+			t.Errorf("%s: %s", archive.format, err)
+			continue
+		}
+		if filepath.Base(output) != "pkg-1.0" {
+			t.Errorf("%s: output directory should be the single top level directory, got %s", archive.format, output)
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(output, "README")); err != nil || string(b) != "readme" {
+			t.Errorf("%s: README is %q %v", archive.format, b, err)
+		}
+	}
+
+	// Strip components removes the top level directory, so the files end up in the destination itself
+	root := t.TempDir()
+	path := filepath.Join(root, "archive.tar")
+	if err := ioutil.WriteFile(path, plain, 0644); err != nil {
+		t.Fatal(err)
+	}
+	output, err := extractArchive(context.Background(), path, filepath.Join(root, "out"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(output, "LINK")); err != nil || string(b) != "readme" {
+		t.Errorf("Stripped LINK is %q %v", b, err)
+	}
+
+	root = t.TempDir()
+	path = filepath.Join(root, "archive.tar.gz")
+	if err := ioutil.WriteFile(path, []byte("<html>rate limited</html>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := extractArchive(context.Background(), path, filepath.Join(root, "out"), 0); err == nil || !strings.Contains(err.Error(), "Unknown archive format") {
+		t.Errorf("Something that isnt an archive should be refused, got %v", err)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// credentials finds the token to use for each host. In order of preference they come from the -token-file, the environment,
+// the pkg files credential_helper, ~/.netrc and lastly the pkg files oauth_token
+type credentials struct {
+	tokenFile     string
+	helper        string
+	manifestToken string // Only used for github.com
+
+	sync.Mutex
+	tokens map[string]string // Host -> token, empty if there isnt one
+}
+
+var auth = &credentials{tokens: make(map[string]string)}
+
+// Environment variables checked for a hosts token
+var tokenVariables = map[string][]string{
+	"github.com": {"GITHUB_TOKEN", "GH_TOKEN"},
+	"gitlab.com": {"GITLAB_TOKEN"},
+}
+
+// The api of a host that uses the hosts token, as it isnt a host tokens are stored for
+var tokenAliases = map[string]string{
+	"api.github.com": "github.com",
+}
+
+// token returns the token for a host, which has to be exactly the host the token is for (other than api.github.com,
+// which uses the github.com token)
+func (c *credentials) token(host string) string {
+	host = strings.ToLower(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if token, ok := c.tokens[host]; ok {
+		return token
+	}
+
+	token := c.lookup(host)
+	if alias, ok := tokenAliases[host]; ok && len(token) == 0 {
+		token = c.lookup(alias)
+	}
+
+	c.tokens[host] = token
+	return token
+}
+
+func (c *credentials) lookup(host string) string {
+	if len(c.tokenFile) != 0 {
+		if token := tokenFromFile(c.tokenFile, host); len(token) != 0 {
+			return token
+		}
+	}
+
+	for _, variable := range tokenVariables[host] {
+		if token := strings.TrimSpace(os.Getenv(variable)); len(token) != 0 {
+			return token
+		}
+	}
+
+	if len(c.helper) != 0 {
+		if token := tokenFromHelper(c.helper, host); len(token) != 0 {
+			return token
+		}
+	}
+
+	if token := tokenFromNetrc(host); len(token) != 0 {
+		return token
+	}
+
+	if host == "github.com" {
+		return c.manifestToken
+	}
+
+	return ""
+}
+
+// tokenFromFile reads a token file, either just a token (for github.com) or lines of "<host> <token>"
+func tokenFromFile(path, host string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		warnf("[WARN] Unable to read token file: %s\n", err)
+		return ""
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) == 1 && len(strings.Fields(lines[0])) == 1 {
+		if host == "github.com" {
+			return strings.TrimSpace(lines[0])
+		}
+		return ""
+	}
+
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && strings.EqualFold(fields[0], host) {
+			return fields[1]
+		}
+	}
+
+	return ""
+}
+
+// tokenFromHelper runs the credential helper with the host as its argument, it should print the token
+// "git" asks git credential fill instead, so whatever git is set up with is used
+func tokenFromHelper(helper, host string) string {
+	var cmd *exec.Cmd
+	if helper == "git" {
+		cmd = exec.Command("git", "credential", "fill")
+		cmd.Stdin = strings.NewReader("protocol=https\nhost=" + host + "\n\n")
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	} else {
+		cmd = exec.Command("sh", "-c", helper+` "$1"`, "credential_helper", host)
+	}
+	cmd.Stderr = os.Stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+
+	if helper != "git" {
+		return strings.TrimSpace(string(output))
+	}
+
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.HasPrefix(line, "password=") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "password="))
+		}
+	}
+
+	return ""
+}
+
+// tokenFromNetrc finds the password for a machine in $NETRC or ~/.netrc
+func tokenFromNetrc(host string) string {
+	path := os.Getenv("NETRC")
+	if len(path) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		path = filepath.Join(home, ".netrc")
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Split(bufio.ScanWords)
+
+	machine, password := "", ""
+	for scanner.Scan() {
+		switch scanner.Text() {
+		case "machine":
+			if strings.EqualFold(machine, host) && len(password) != 0 {
+				return password
+			}
+			scanner.Scan()
+			machine, password = scanner.Text(), ""
+		case "default":
+			if strings.EqualFold(machine, host) && len(password) != 0 {
+				return password
+			}
+			machine, password = "", ""
+		case "password":
+			scanner.Scan()
+			password = scanner.Text()
+		case "login", "account", "macdef":
+			scanner.Scan()
+		}
+	}
+
+	if strings.EqualFold(machine, host) {
+		return password
+	}
+
+	return ""
+}
+
+// authTransport adds the token for a requests host, if there is one. Tokens are only sent to the host they are for, so
+// mirrors and the storage github redirects release assets to never see them, and only over https (or to this machine)
+type authTransport struct {
+	base http.RoundTripper
+}
+
+func (t authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(req.Header.Get("Authorization")) != 0 || !sendsTokens(req) {
+		return t.base.RoundTrip(req)
+	}
+
+	token := auth.token(req.URL.Host)
+	if len(token) == 0 {
+		return t.base.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	return t.base.RoundTrip(req)
+}
+
+func sendsTokens(req *http.Request) bool {
+	if req.URL.Scheme == "https" {
+		return true
+	}
+
+	ip := net.ParseIP(req.URL.Hostname())
+	return req.URL.Hostname() == "localhost" || ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestTokenHosts(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("NETRC", filepath.Join(dir, "netrc"))
+	for _, variable := range []string{"GITHUB_TOKEN", "GH_TOKEN", "GITLAB_TOKEN"} {
+		t.Setenv(variable, "")
+	}
+
+	tokenFile := filepath.Join(dir, "tokens")
+	if err := ioutil.WriteFile(tokenFile, []byte("github.com gh\nexample.com ex\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &credentials{tokenFile: tokenFile, tokens: make(map[string]string)}
+
+	tests := []struct {
+		host  string
+		token string
+	}{
+		{"github.com", "gh"},
+		{"GitHub.com:443", "gh"},
+		{"api.github.com", "gh"},
+		{"uploads.github.com", ""},
+		{"example.com", "ex"},
+		{"gitlab.example.com", ""},
+		{"evil.github.com.example.org", ""},
+	}
+
+	for _, test := range tests {
+		if token := c.token(test.host); token != test.token {
+			t.Errorf("token(%s) = %q, want %q", test.host, token, test.token)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Downloads are kept in cache/objects/ named by their sha256, with an entry in cache/http/ per url recording which
+// object it last returned and the validators (ETag, Last-Modified) needed to ask the server whether it has changed
+const (
+	objectCache = "cache/objects"
+	httpCache   = "cache/http"
+)
+
+type httpCacheEntry struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	SHA256       string `json:"sha256"`
+	Size         int64  `json:"size"`
+}
+
+func httpCachePath(url string) string {
+	hash := sha1.Sum([]byte(url))
+	return filepath.Join(httpCache, hex.EncodeToString(hash[:])+".json")
+}
+
+func objectPath(digest string) string {
+	return filepath.Join(objectCache, digest)
+}
+
+func loadHTTPCacheEntry(url string) (entry httpCacheEntry, ok bool) {
+	b, err := ioutil.ReadFile(httpCachePath(url))
+	if err != nil {
+		return entry, false
+	}
+
+	if json.Unmarshal(b, &entry) != nil || entry.URL != url {
+		return entry, false
+	}
+
+	// The entry is only useful if the bytes it refers to are still there
+	if info, err := os.Stat(objectPath(entry.SHA256)); err != nil || info.Size() != entry.Size {
+		return entry, false
+	}
+
+	return entry, true
+}
+
+func (e httpCacheEntry) write() error {
+	if err := os.MkdirAll(httpCache, 0700); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(httpCachePath(e.URL), b, 0600)
+}
+
+// downloadFile fetches url into path, using a conditional request so that an unchanged file is served from the cache
+// Returns the sha256 of the downloaded file. progress can be nil
+func downloadFile(path string, url string, progress *transfer) (digest string, err error) {
+	// Failed requests are retried by the client, this covers the connection dropping part way through the body
+	for attempt := 0; ; attempt++ {
+		digest, err = downloadOnce(path, url, progress)
+
+		var interrupted interruptedDownload
+		if err == nil || !errors.As(err, &interrupted) || attempt >= network.retries {
+			return digest, err
+		}
+
+		wait := backoff(attempt)
+		warnf("[Retry] %s: %s, trying again in %s (%d/%d)\n", url, err, wait.Round(100*time.Millisecond), attempt+1, network.retries)
+		time.Sleep(wait)
+	}
+}
+
+// interruptedDownload is a download that failed after the server started sending it
+type interruptedDownload struct {
+	err error
+}
+
+func (i interruptedDownload) Error() string {
+	return "Download interrupted: " + i.err.Error()
+}
+
+func downloadOnce(path string, url string, progress *transfer) (digest string, err error) {
+
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	entry, cached := loadHTTPCacheEntry(url)
+	if cached {
+		if len(entry.ETag) != 0 {
+			request.Header.Set("If-None-Match", entry.ETag)
+		}
+		if len(entry.LastModified) != 0 {
+			request.Header.Set("If-Modified-Since", entry.LastModified)
+		}
+	}
+
+	resp, err := downloadClient().Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached:
+		// Nothing to do, the object we already have is current
+		progress.unchanged()
+
+	case resp.StatusCode == http.StatusOK:
+		entry = httpCacheEntry{
+			URL:          url,
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+		}
+
+		progress.setTotal(resp.ContentLength)
+
+		entry.SHA256, entry.Size, err = storeObject(progress.reader(resp.Body))
+		if err != nil {
+			return "", interruptedDownload{err}
+		}
+
+		if err := entry.write(); err != nil {
+			return "", err
+		}
+
+	default:
+		return "", fmt.Errorf("Downloading %s failed: %s", url, resp.Status)
+	}
+
+	return entry.SHA256, copyObject(entry.SHA256, path)
+}
+
+// storeObject streams r into the object cache, naming it by its sha256
+func storeObject(r io.Reader) (digest string, size int64, err error) {
+	if err := os.MkdirAll(objectCache, 0700); err != nil {
+		return "", 0, err
+	}
+
+	temporary, err := ioutil.TempFile(objectCache, ".download-")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(temporary.Name())
+
+	h := sha256.New()
+	size, err = io.Copy(io.MultiWriter(temporary, h), r)
+	temporary.Close()
+	if err != nil {
+		return "", 0, err
+	}
+
+	digest = hex.EncodeToString(h.Sum(nil))
+
+	return digest, size, os.Rename(temporary.Name(), objectPath(digest))
+}
+
+// copyObject places a cached object at path, verifying it hasnt been damaged since it was stored
+// It is copied to a temporary file next to path first, so path is either the whole verified object or untouched
+func copyObject(digest, path string) error {
+	in, err := os.Open(objectPath(digest))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, h), in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if hex.EncodeToString(h.Sum(nil)) != digest {
+		os.Remove(objectPath(digest))
+		return fmt.Errorf("Cached download %s is corrupt, it has been removed so try again", digest)
+	}
+
+	// TempFile makes it 0600, os.Create would have been 0666 before the umask
+	if err := os.Chmod(out.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(out.Name(), path)
+}
+
+// forgetDownload removes a download that turned out to be bad, along with its cached object and http cache entry, so the
+// next run fetches it again instead of being told it hasnt changed
+func forgetDownload(path, url, digest string) {
+	os.Remove(path)
+	os.Remove(httpCachePath(url))
+	if len(digest) != 0 {
+		os.Remove(objectPath(digest))
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCopyObject(t *testing.T) {
+	inDirectory(t, t.TempDir())
+
+	digest, _, err := storeObject(strings.NewReader("archive"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll("out", 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join("out", "pkg.tar.gz")
+	if err := copyObject(digest, path); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(path); err != nil || string(b) != "archive" {
+		t.Errorf("Copied object is %q %v", b, err)
+	}
+
+	// A damaged object leaves whatever was at path alone, and no temporary file behind
+	if err := ioutil.WriteFile(objectPath(digest), []byte("damaged"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyObject(digest, path); err == nil || !strings.Contains(err.Error(), "corrupt") {
+		t.Errorf("Copying a damaged object should fail, got %v", err)
+	}
+	if b, err := ioutil.ReadFile(path); err != nil || string(b) != "archive" {
+		t.Errorf("A failed copy changed the existing file to %q %v", b, err)
+	}
+	if Exists(objectPath(digest)) {
+		t.Errorf("The damaged object should have been removed from the cache")
+	}
+
+	entries, err := os.ReadDir("out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Temporary files were left behind: %v", entries)
+	}
+}
@@ -0,0 +1,851 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Pkg files can be json, yaml or toml. Yaml and toml are turned into json and then decoded exactly like a json pkg file,
+// so all three have the same fields and checks
+const (
+	jsonFormat = "json"
+	yamlFormat = "yaml"
+	tomlFormat = "toml"
+)
+
+var tomlLine = regexp.MustCompile(`^\s*(\[|[A-Za-z0-9_"'.$-]+\s*=)`)
+
+// manifestFormat works out the format of a pkg file from its extension, or if that doesnt say from what it looks like
+func manifestFormat(file string, contents []byte) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".json":
+		return jsonFormat
+	case ".yaml", ".yml":
+		return yamlFormat
+	case ".toml":
+		return tomlFormat
+	}
+
+	for _, line := range strings.Split(string(contents), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if len(trimmed) == 0 || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(trimmed, "{"):
+			return jsonFormat
+		case tomlLine.MatchString(line):
+			return tomlFormat
+		}
+		return yamlFormat
+	}
+
+	return jsonFormat
+}
+
+// orderedObject is an object from a pkg file that remembers the order of its keys, so converting between formats
+// doesnt shuffle them. Documents are made of these, []interface{}, string, json.Number, bool and nil
+type orderedObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newOrderedObject() *orderedObject {
+	return &orderedObject{values: make(map[string]interface{})}
+}
+
+func (o *orderedObject) set(key string, value interface{}) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+func (o *orderedObject) remove(key string) {
+	if _, ok := o.values[key]; !ok {
+		return
+	}
+
+	delete(o.values, key)
+	for i, k := range o.keys {
+		if k == key {
+			o.keys = append(o.keys[:i], o.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// parseManifest reads a pkg file into a document, along with the byte offset of each path in it (e.g packages[1].depends)
+// t is what the document is of, a pkgManifest or a Package on its own
+func parseManifest(file string, contents []byte, format string, t reflect.Type) (doc interface{}, positions map[string]int, err error) {
+	switch format {
+	case yamlFormat:
+		return parseYAML(file, contents, t)
+	case tomlFormat:
+		return parseTOML(file, contents)
+	}
+
+	doc, err = parseJSON(contents)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", file, err)
+	}
+	return doc, nil, nil
+}
+
+func parseJSON(contents []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.UseNumber()
+
+	var value func() (interface{}, error)
+	value = func() (interface{}, error) {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		switch token {
+		case json.Delim('{'):
+			object := newOrderedObject()
+			for decoder.More() {
+				key, err := decoder.Token()
+				if err != nil {
+					return nil, err
+				}
+
+				v, err := value()
+				if err != nil {
+					return nil, err
+				}
+				object.set(key.(string), v)
+			}
+			_, err = decoder.Token()
+			return object, err
+
+		case json.Delim('['):
+			list := []interface{}{}
+			for decoder.More() {
+				v, err := value()
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, v)
+			}
+			_, err = decoder.Token()
+			return list, err
+		}
+
+		return token, nil
+	}
+
+	doc, err := value()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("Unexpected data after the end of the pkg file")
+	}
+
+	return doc, nil
+}
+
+// lineOffsets finds where each line starts, for turning the line and column a parser gives into an offset
+func lineOffsets(contents []byte) []int {
+	offsets := []int{0}
+	for i, c := range contents {
+		if c == '\n' {
+			offsets = append(offsets, i+1)
+		}
+	}
+	return offsets
+}
+
+func offsetOf(contents []byte, lines []int, line, column int) int {
+	if line < 1 || line > len(lines) {
+		return -1
+	}
+
+	offset := lines[line-1]
+	for ; column > 1 && offset < len(contents) && contents[offset] != '\n'; column-- {
+		_, size := utf8.DecodeRune(contents[offset:])
+		offset += size
+	}
+	return offset
+}
+
+func parseYAML(file string, contents []byte, t reflect.Type) (interface{}, map[string]int, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(contents, &root); err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", file, strings.TrimPrefix(err.Error(), "yaml: "))
+	}
+
+	p := yamlParser{contents: contents, lines: lineOffsets(contents), positions: make(map[string]int)}
+	if len(root.Content) == 0 {
+		return newOrderedObject(), p.positions, nil
+	}
+
+	doc, err := p.value(root.Content[0], "", t)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", file, err)
+	}
+
+	return doc, p.positions, nil
+}
+
+type yamlParser struct {
+	contents  []byte
+	lines     []int
+	positions map[string]int
+}
+
+// value converts a yaml node, t is the type it will be decoded into. Values going into a string are kept exactly as
+// written, so "version: 1.10" stays "1.10" rather than becoming the number 1.1
+func (p *yamlParser) value(node *yaml.Node, path string, t reflect.Type) (interface{}, error) {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+
+	if _, ok := p.positions[path]; !ok {
+		p.positions[path] = offsetOf(p.contents, p.lines, node.Line, node.Column)
+	}
+
+	switch node.Kind {
+	case yaml.MappingNode:
+		var fields map[string]reflect.Type
+		var elem reflect.Type
+		if t != nil && t.Kind() == reflect.Struct {
+			fields = jsonFields(t)
+		} else if t != nil && t.Kind() == reflect.Map {
+			elem = t.Elem()
+		}
+
+		pairs, err := mergedPairs(node, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		object := newOrderedObject()
+		for i := 0; i+1 < len(pairs); i += 2 {
+			key, valueNode := pairs[i], pairs[i+1]
+
+			child := key.Value
+			if len(path) != 0 {
+				child = path + "." + key.Value
+			}
+			p.positions[child] = offsetOf(p.contents, p.lines, key.Line, key.Column)
+
+			childType := elem
+			if fields != nil {
+				childType = fields[strings.ToLower(key.Value)]
+			}
+
+			v, err := p.value(valueNode, child, childType)
+			if err != nil {
+				return nil, err
+			}
+			object.set(key.Value, v)
+		}
+		return object, nil
+
+	case yaml.SequenceNode:
+		var elem reflect.Type
+		if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+			elem = t.Elem()
+		}
+
+		list := []interface{}{}
+		for i, item := range node.Content {
+			v, err := p.value(item, fmt.Sprintf("%s[%d]", path, i), elem)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+
+	case yaml.ScalarNode:
+		if node.Tag == "!!null" {
+			return nil, nil
+		}
+
+		if t != nil && t.Kind() == reflect.String {
+			return node.Value, nil
+		}
+
+		switch node.Tag {
+		case "!!int", "!!float":
+			var number float64
+			if err := node.Decode(&number); err != nil {
+				return nil, fmt.Errorf("line %d: %s", node.Line, err)
+			}
+			if node.Tag == "!!int" {
+				return json.Number(strconv.FormatInt(int64(number), 10)), nil
+			}
+			return json.Number(strconv.FormatFloat(number, 'g', -1, 64)), nil
+		case "!!bool":
+			var b bool
+			if err := node.Decode(&b); err != nil {
+				return nil, fmt.Errorf("line %d: %s", node.Line, err)
+			}
+			return b, nil
+		}
+
+		return node.Value, nil
+	}
+
+	return nil, fmt.Errorf("line %d: unsupported yaml", node.Line)
+}
+
+// mergedPairs returns the keys and values of a mapping with its merge keys (<<: *anchor, or a list of anchors) expanded,
+// so the fields they bring in are checked like any other. Keys written in the mapping win over merged ones, and
+// earlier merged mappings win over later ones
+func mergedPairs(node *yaml.Node, depth int) ([]*yaml.Node, error) {
+	if depth > 32 {
+		return nil, fmt.Errorf("line %d: merge keys nested too deeply", node.Line)
+	}
+
+	explicit := make(map[string]bool)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].ShortTag() != "!!merge" {
+			explicit[node.Content[i].Value] = true
+		}
+	}
+
+	pairs := []*yaml.Node{}
+	added := make(map[string]bool)
+	add := func(key, value *yaml.Node) {
+		if !added[key.Value] {
+			added[key.Value] = true
+			pairs = append(pairs, key, value)
+		}
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if key.ShortTag() != "!!merge" {
+			add(key, value)
+			continue
+		}
+
+		sources := []*yaml.Node{value}
+		if value.Kind == yaml.SequenceNode {
+			sources = value.Content
+		}
+
+		for _, source := range sources {
+			if source.Kind == yaml.AliasNode {
+				source = source.Alias
+			}
+			if source.Kind != yaml.MappingNode {
+				return nil, fmt.Errorf("line %d: merge key needs a mapping or a list of mappings", value.Line)
+			}
+
+			merged, err := mergedPairs(source, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			for j := 0; j+1 < len(merged); j += 2 {
+				if !explicit[merged[j].Value] {
+					add(merged[j], merged[j+1])
+				}
+			}
+		}
+	}
+
+	return pairs, nil
+}
+
+var tomlErrorPrefix = regexp.MustCompile(`^toml: line \d+( \(last key "[^"]*"\))?: `)
+
+func parseTOML(file string, contents []byte) (interface{}, map[string]int, error) {
+	var raw map[string]interface{}
+	meta, err := toml.Decode(string(contents), &raw)
+	if err != nil {
+		if parseError, ok := err.(toml.ParseError); ok {
+			line, column := manifestIndex{contents: contents}.lineColumn(parseError.Position.Start)
+			message := parseError.Message
+			if len(message) == 0 {
+				// Some errors only have their message in Error(), after the line the position already gives
+				message = tomlErrorPrefix.ReplaceAllString(parseError.Error(), "")
+			}
+			return nil, nil, fmt.Errorf("%s:%d:%d: %s", file, line, column, message)
+		}
+		return nil, nil, fmt.Errorf("%s: %s", file, err)
+	}
+
+	// Keys are listed in the order they are in the file, which is the order we want them in
+	order := make(map[string]int)
+	for i, key := range meta.Keys() {
+		if _, ok := order[key.String()]; !ok {
+			order[key.String()] = i
+		}
+	}
+
+	t := tomlConverter{order: order, positions: tomlPositions(contents)}
+	return t.value(raw, "", ""), t.positions, nil
+}
+
+// tomlConverter puts keys back in the order they are in the file. Where they are is the best guide, as the toml library
+// only says which order keys first appeared in (so a key only in the second [[packages]] would go after all the first ones keys)
+type tomlConverter struct {
+	order     map[string]int
+	positions map[string]int
+}
+
+// value converts a decoded value, key is its toml key path and path its path with array indexes
+func (t tomlConverter) value(value interface{}, key, path string) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		keys := []string{}
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		sort.SliceStable(keys, func(i, j int) bool {
+			a, aFound := t.positions[joinPath(path, keys[i])]
+			b, bFound := t.positions[joinPath(path, keys[j])]
+			if aFound && bFound {
+				return a < b
+			}
+			return t.order[tomlKey(key, keys[i])] < t.order[tomlKey(key, keys[j])]
+		})
+
+		object := newOrderedObject()
+		for _, k := range keys {
+			object.set(k, t.value(v[k], tomlKey(key, k), joinPath(path, k)))
+		}
+		return object
+	case []map[string]interface{}:
+		list := []interface{}{}
+		for i, item := range v {
+			list = append(list, t.value(item, key, fmt.Sprintf("%s[%d]", path, i)))
+		}
+		return list
+	case []interface{}:
+		list := []interface{}{}
+		for i, item := range v {
+			list = append(list, t.value(item, key, fmt.Sprintf("%s[%d]", path, i)))
+		}
+		return list
+	case int64:
+		return json.Number(strconv.FormatInt(v, 10))
+	case float64:
+		return json.Number(strconv.FormatFloat(v, 'g', -1, 64))
+	case time.Time:
+		return v.Format(time.RFC3339)
+	case string, bool:
+		return v
+	}
+
+	return fmt.Sprint(value)
+}
+
+// tomlKey is how the toml library writes a key path, which is how order is keyed
+func tomlKey(parent, key string) string {
+	k := toml.Key{key}.String()
+	if len(parent) == 0 {
+		return k
+	}
+	return parent + "." + k
+}
+
+var (
+	tomlHeader     = regexp.MustCompile(`^\s*(\[\[?)\s*([^\]]+?)\s*\]\]?`)
+	tomlKeyValue   = regexp.MustCompile(`^\s*("[^"]*"|'[^']*'|[A-Za-z0-9_.$-]+)\s*=`)
+	tomlKeySegment = regexp.MustCompile(`"[^"]*"|'[^']*'|[^.]+`)
+)
+
+// tomlPositions finds where each table and key is, by reading the file line by line. It only has to be good enough to
+// point at the right line, anything it misses falls back to the table it is in
+func tomlPositions(contents []byte) map[string]int {
+	positions := make(map[string]int)
+	arrays := make(map[string]int) // Array of tables path -> how many there have been so far
+
+	table := ""
+	inString := false
+	offset := 0
+	for _, line := range strings.SplitAfter(string(contents), "\n") {
+		start := offset
+		offset += len(line)
+
+		if strings.Count(line, `"""`)%2 == 1 || strings.Count(line, `'''`)%2 == 1 {
+			inString = !inString
+			continue
+		}
+		if inString {
+			continue
+		}
+
+		if m := tomlHeader.FindStringSubmatch(line); m != nil {
+			segments := splitTOMLKey(m[2])
+			table = ""
+			for i, segment := range segments {
+				table = joinPath(table, segment)
+				if i == len(segments)-1 && m[1] == "[[" {
+					arrays[table]++
+				}
+				if arrays[table] > 0 {
+					table = fmt.Sprintf("%s[%d]", table, arrays[table]-1)
+				}
+			}
+
+			if _, ok := positions[table]; !ok {
+				positions[table] = start + strings.Index(line, "[")
+			}
+			continue
+		}
+
+		if m := tomlKeyValue.FindStringSubmatchIndex(line); m != nil {
+			path := table
+			for _, segment := range splitTOMLKey(line[m[2]:m[3]]) {
+				path = joinPath(path, segment)
+			}
+			positions[path] = start + m[2]
+		}
+	}
+
+	return positions
+}
+
+func splitTOMLKey(key string) (segments []string) {
+	for _, segment := range tomlKeySegment.FindAllString(key, -1) {
+		segment = strings.TrimSpace(segment)
+		if unquoted, err := strconv.Unquote(segment); err == nil {
+			segment = unquoted
+		}
+		segments = append(segments, strings.Trim(segment, "'"))
+	}
+	return segments
+}
+
+func joinPath(parent, key string) string {
+	if len(parent) == 0 {
+		return key
+	}
+	return parent + "." + key
+}
+
+// marshalDocument writes a document out in a format, keeping its keys in order
+func marshalDocument(doc interface{}, format string) ([]byte, error) {
+	b := bytes.Buffer{}
+
+	switch format {
+	case yamlFormat:
+		encoder := yaml.NewEncoder(&b)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(yamlNode(doc)); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), encoder.Close()
+
+	case tomlFormat:
+		object, ok := doc.(*orderedObject)
+		if !ok {
+			return nil, fmt.Errorf("Only an object can be written as toml")
+		}
+		writeTOMLTable(&b, object, "")
+		return b.Bytes(), nil
+	}
+
+	writeJSON(&b, doc, "")
+	b.WriteString("\n")
+	return b.Bytes(), nil
+}
+
+// writeJSON indents with tabs like the rest of the pkg files
+func writeJSON(b *bytes.Buffer, value interface{}, indent string) {
+	switch v := value.(type) {
+	case *orderedObject:
+		if len(v.keys) == 0 {
+			b.WriteString("{}")
+			return
+		}
+
+		b.WriteString("{\n")
+		for i, key := range v.keys {
+			b.WriteString(indent + "\t" + jsonString(key) + ": ")
+			writeJSON(b, v.values[key], indent+"\t")
+			if i != len(v.keys)-1 {
+				b.WriteString(",")
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString(indent + "}")
+
+	case []interface{}:
+		if len(v) == 0 {
+			b.WriteString("[]")
+			return
+		}
+
+		// Lists of strings and numbers like depends go on one line
+		scalars := []string{}
+		for _, item := range v {
+			switch item.(type) {
+			case *orderedObject, []interface{}:
+			default:
+				item := bytes.Buffer{}
+				writeJSON(&item, v[len(scalars)], "")
+				scalars = append(scalars, item.String())
+				continue
+			}
+			break
+		}
+		if len(scalars) == len(v) {
+			b.WriteString("[" + strings.Join(scalars, ", ") + "]")
+			return
+		}
+
+		b.WriteString("[\n")
+		for i, item := range v {
+			b.WriteString(indent + "\t")
+			writeJSON(b, item, indent+"\t")
+			if i != len(v)-1 {
+				b.WriteString(",")
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString(indent + "]")
+
+	case string:
+		b.WriteString(jsonString(v))
+	case json.Number:
+		b.WriteString(v.String())
+	case bool:
+		b.WriteString(strconv.FormatBool(v))
+	default:
+		b.WriteString("null")
+	}
+}
+
+func jsonString(s string) string {
+	b := bytes.Buffer{}
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(s)
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func yamlNode(value interface{}) *yaml.Node {
+	switch v := value.(type) {
+	case *orderedObject:
+		node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		for _, key := range v.keys {
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, yamlNode(v.values[key]))
+		}
+		return node
+
+	case []interface{}:
+		node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		scalars := true
+		for _, item := range v {
+			child := yamlNode(item)
+			scalars = scalars && child.Kind == yaml.ScalarNode && !strings.Contains(child.Value, "\n")
+			node.Content = append(node.Content, child)
+		}
+
+		// Short lists like depends read better on one line
+		if scalars {
+			node.Style = yaml.FlowStyle
+		}
+		return node
+
+	case string:
+		node := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v}
+		if strings.Contains(v, "\n") {
+			node.Style = yaml.LiteralStyle
+		}
+		return node
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: v.String()}
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!float", Value: v.String()}
+	case bool:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(v)}
+	}
+
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}
+}
+
+var tomlBareKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func tomlKeyString(key string) string {
+	if tomlBareKey.MatchString(key) {
+		return key
+	}
+	return jsonString(key)
+}
+
+// writeTOMLTable writes the plain values of a table, then its sub tables and arrays of tables, which have to come after them
+// Toml has no null, so null values are left out
+func writeTOMLTable(b *bytes.Buffer, object *orderedObject, path string) {
+	isTable := func(v interface{}) bool {
+		_, ok := v.(*orderedObject)
+		return ok
+	}
+	isTableArray := func(v interface{}) bool {
+		list, ok := v.([]interface{})
+		if !ok || len(list) == 0 {
+			return false
+		}
+		for _, item := range list {
+			if !isTable(item) {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, key := range object.keys {
+		v := object.values[key]
+		if v == nil || isTable(v) || isTableArray(v) {
+			continue
+		}
+		b.WriteString(tomlKeyString(key) + " = " + tomlInline(v) + "\n")
+	}
+
+	for _, key := range object.keys {
+		name := joinPath(path, tomlKeyString(key))
+
+		switch v := object.values[key].(type) {
+		case *orderedObject:
+			b.WriteString("\n[" + name + "]\n")
+			writeTOMLTable(b, v, name)
+		case []interface{}:
+			if !isTableArray(v) {
+				continue
+			}
+			for _, item := range v {
+				b.WriteString("\n[[" + name + "]]\n")
+				writeTOMLTable(b, item.(*orderedObject), name)
+			}
+		}
+	}
+}
+
+// tomlInline writes a value on one line, apart from multi-line strings
+func tomlInline(value interface{}) string {
+	switch v := value.(type) {
+	case *orderedObject:
+		parts := []string{}
+		for _, key := range v.keys {
+			if v.values[key] != nil {
+				parts = append(parts, tomlKeyString(key)+" = "+tomlInline(v.values[key]))
+			}
+		}
+		return "{" + strings.Join(parts, ", ") + "}"
+	case []interface{}:
+		parts := []string{}
+		for _, item := range v {
+			parts = append(parts, tomlInline(item))
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	case string:
+		if strings.Contains(v, "\n") && !strings.Contains(v, "'''") {
+			return "'''\n" + v + "'''"
+		}
+		return jsonString(v)
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	}
+
+	return `""`
+}
+
+// convert translates a pkg file between json, yaml and toml, the format of the output is from its extension or -to
+func convert(args []string) error {
+	flags := flag.NewFlagSet("convert", flag.ExitOnError)
+	to := flags.String("to", "", "Format to convert to (json, yaml or toml), needed when printing rather than writing a file")
+	flags.Parse(args)
+
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return fmt.Errorf("Usage: convert [-to json|yaml|toml] <pkg file> [output file]")
+	}
+
+	contents, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	output := flags.Arg(1)
+	format := *to
+	if len(format) == 0 && len(output) != 0 {
+		format = manifestFormat(output, nil)
+		if filepath.Ext(output) == "" {
+			format = ""
+		}
+	}
+
+	switch format {
+	case jsonFormat, yamlFormat, tomlFormat:
+	case "":
+		return fmt.Errorf("Cant tell which format to convert to, use -to json, yaml or toml")
+	default:
+		return fmt.Errorf("Unknown format '%s', use json, yaml or toml", format)
+	}
+
+	// The pkg file has to be valid first, otherwise there is no knowing whether the conversion is right
+	settings, idx, problems, err := decodeManifest(flags.Arg(0), contents)
+	if err != nil {
+		return err
+	}
+	if len(problems) != 0 {
+		return idx.errorOf(problems)
+	}
+
+	doc, _, err := parseManifest(flags.Arg(0), contents, manifestFormat(flags.Arg(0), contents), reflect.TypeOf(settings))
+	if err != nil {
+		return err
+	}
+
+	converted, err := marshalDocument(doc, format)
+	if err != nil {
+		return err
+	}
+
+	// Make sure the conversion reads back as exactly the same pkg file
+	check, _, problems, err := decodeManifest("converted."+format, converted)
+	if err != nil || len(problems) != 0 || !reflect.DeepEqual(check, settings) {
+		return fmt.Errorf("Converting %s to %s doesnt give the same pkg file back, please report this", flags.Arg(0), format)
+	}
+
+	if len(output) == 0 {
+		_, err = os.Stdout.Write(converted)
+		return err
+	}
+
+	if Exists(output) {
+		return fmt.Errorf("%s already exists, remove it first", output)
+	}
+
+	if err := ioutil.WriteFile(output, converted, 0644); err != nil {
+		return err
+	}
+
+	fmt.Printf("Converted %s to %s, comments arent carried over\n", flags.Arg(0), output)
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestYAMLMergeKeys(t *testing.T) {
+	tests := []struct {
+		name      string
+		yaml      string
+		configure string
+		build     string
+		problem   string // Expected in the formatted problems, empty if there shouldnt be any
+	}{
+		{
+			name: "merge",
+			yaml: `packages:
+  - &base
+    name: base
+    repo: owner/base
+    configure_opts: ./configure
+    build: make
+  - <<: *base
+    name: merged
+    build: make all
+`,
+			configure: "./configure",
+			build:     "make all",
+		},
+		{
+			name: "explicit tag",
+			yaml: `packages:
+  - &base
+    name: base
+    repo: owner/base
+    configure_opts: ./configure
+    build: make
+  - !!merge <<: *base
+    name: merged
+`,
+			configure: "./configure",
+			build:     "make",
+		},
+		{
+			name: "list, earlier wins",
+			yaml: `packages:
+  - &first
+    name: first
+    repo: owner/first
+    build: make first
+  - &second
+    name: second
+    repo: owner/second
+    configure_opts: ./configure
+    build: make second
+  - <<: [*first, *second]
+    name: merged
+`,
+			configure: "./configure",
+			build:     "make first",
+		},
+		{
+			name: "unknown field brought in by a merge",
+			yaml: `packages:
+  - &base
+    name: base
+    repo: owner/base
+    biuld: make
+  - <<: *base
+    name: merged
+`,
+			problem: `test.yaml:5:5: error: packages[0].biuld: unknown field "biuld", did you mean "build"?`,
+		},
+		{
+			name: "merging a scalar",
+			yaml: `packages:
+  - <<: make
+    name: merged
+`,
+			problem: "merge key needs a mapping",
+		},
+	}
+
+	for _, test := range tests {
+		settings, idx, problems, err := decodeManifest("test.yaml", []byte(test.yaml))
+
+		reported := ""
+		if err != nil {
+			reported = err.Error()
+		} else if len(problems) != 0 {
+			reported = idx.errorOf(problems).Error()
+		}
+
+		if len(test.problem) != 0 {
+			if !strings.Contains(reported, test.problem) {
+				t.Errorf("%s: should have reported %q, got %q", test.name, test.problem, reported)
+			}
+			continue
+		}
+
+		if len(reported) != 0 {
+			t.Errorf("%s: %s", test.name, reported)
+			continue
+		}
+
+		merged := settings.Packages[len(settings.Packages)-1]
+		if merged.Name != "merged" || merged.ConfigurationOptions != test.configure || merged.Build != test.build {
+			t.Errorf("%s: got name %q configure %q build %q, want merged %q %q", test.name, merged.Name, merged.ConfigurationOptions, merged.Build, test.configure, test.build)
+		}
+	}
+}
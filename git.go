@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// gitMirror is a bare mirror of a repository kept under cache/git/, so fetching a new version only pulls the changes
+type gitMirror struct {
+	repository string
+	path       string
+}
+
+func git(dir string, args ...string) (output []byte, err error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+
+	stderr := bytes.Buffer{}
+	cmd.Stderr = &stderr
+
+	output, err = cmd.Output()
+	if err != nil {
+		return output, fmt.Errorf("git %s failed: %s %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+
+	return output, nil
+}
+
+// mirrorName is what a repositorys mirror (and its vendored bundle) is called
+func mirrorName(repository string) string {
+	hash := sha1.Sum([]byte(repository))
+	return hex.EncodeToString(hash[:])
+}
+
+// mirrorLocks has a mutex per mirror path, as packages fetched in parallel can share a repository (or a submodule) and
+// two clones or updates of the same mirror at once trip over each other
+var mirrorLocks sync.Map
+
+func lockMirror(path string) (unlock func()) {
+	lock, _ := mirrorLocks.LoadOrStore(path, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	return lock.(*sync.Mutex).Unlock
+}
+
+// openGitMirror clones the mirror if it doesnt exist yet, or fetches anything new if it does and update is set
+// Without update the mirror is brought up to date from a bundle in one of vendorDirectories instead, if there is one
+func openGitMirror(repository string, update bool, vendorDirectories ...string) (m gitMirror, err error) {
+	m.repository = repository
+	m.path, err = filepath.Abs(filepath.Join("cache", "git", mirrorName(repository)+".git"))
+	if err != nil {
+		return m, err
+	}
+
+	defer lockMirror(m.path)()
+
+	if !update {
+		for _, directory := range vendorDirectories {
+			if bundle := vendoredBundle(directory, repository); Exists(bundle) {
+				return m, m.fromBundle(bundle)
+			}
+		}
+	}
+
+	if directoryExists(m.path) {
+		if update {
+			_, err = git(m.path, "remote", "update", "--prune")
+		}
+		return m, err
+	}
+
+	if !update {
+		return m, offlineError(repository)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(m.path), 0700); err != nil {
+		return m, err
+	}
+
+	_, err = git("", "clone", "--mirror", "--quiet", repository, m.path)
+	return m, err
+}
+
+// fromBundle fetches everything in a vendored bundle into the mirror, cloning the mirror from it if there isnt one yet
+func (m gitMirror) fromBundle(bundle string) error {
+	bundle, err := filepath.Abs(bundle)
+	if err != nil {
+		return err
+	}
+
+	if directoryExists(m.path) {
+		_, err = git(m.path, "fetch", "--quiet", bundle, "+refs/*:refs/*")
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(m.path), 0700); err != nil {
+		return err
+	}
+
+	if _, err := git("", "clone", "--mirror", "--quiet", bundle, m.path); err != nil {
+		return err
+	}
+
+	// So updating it later on fetches from upstream rather than the bundle
+	_, err = git(m.path, "remote", "set-url", "origin", m.repository)
+	return err
+}
+
+// bundle writes everything in the mirror to a single file, along with the mirrors of the submodules commit uses, so the
+// commit can be checked out on a machine without network access. The mirrors are only updated if they dont have the commits
+func (m gitMirror) bundle(commit, vendorDirectory string) (bundles []string, err error) {
+	if !m.has(commit) {
+		if m, err = openGitMirror(m.repository, true); err != nil {
+			return nil, err
+		}
+	}
+
+	path, err := filepath.Abs(vendoredBundle(vendorDirectory, m.repository))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	if _, err := git(m.path, "bundle", "create", path, "--all"); err != nil {
+		return nil, err
+	}
+	bundles = append(bundles, path)
+
+	submodules, err := m.submodules(commit)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range submodules {
+		sm, err := openGitMirror(s.repository, false)
+		if err != nil {
+			sm, err = openGitMirror(s.repository, true)
+		}
+
+		var more []string
+		if err == nil {
+			more, err = sm.bundle(s.commit, vendorDirectory)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Submodule %s: %s", s.path, err)
+		}
+		bundles = append(bundles, more...)
+	}
+
+	return bundles, nil
+}
+
+func (m gitMirror) Tags() (tags []remoteTag, err error) {
+	// Annotated tags are peeled (*objectname) to the commit they point at, lightweight tags already are a commit
+	output, err := git(m.path, "for-each-ref", "--format=%(refname:strip=2) %(objectname) %(*objectname)", "refs/tags")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		commit := fields[1]
+		if len(fields) == 3 {
+			commit = fields[2]
+		}
+
+		tags = append(tags, newRemoteTag(fields[0], commit))
+	}
+
+	return tags, nil
+}
+
+func (m gitMirror) Revision(revision string) (string, error) {
+	for _, candidate := range []string{"refs/tags/" + revision, "refs/heads/" + revision, revision} {
+		output, err := git(m.path, "rev-parse", "--verify", "--quiet", candidate+"^{commit}")
+		if err == nil {
+			return strings.TrimSpace(string(output)), nil
+		}
+	}
+
+	return "", fmt.Errorf("Version '%s' is not a tag, branch or commit in %s", revision, m.repository)
+}
+
+func (m gitMirror) String() string {
+	return m.repository
+}
+
+// has is whether the mirror has a commit
+func (m gitMirror) has(commit string) bool {
+	_, err := git(m.path, "cat-file", "-e", commit+"^{commit}")
+	return err == nil
+}
+
+// submodule is a submodule of a commit, with its url resolved against the repository it is in
+type submodule struct {
+	path       string
+	repository string
+	commit     string
+}
+
+// submodules reads the submodules of a commit from the mirror, rather than a checkout, so they can be checked out from
+// their own mirrors
+func (m gitMirror) submodules(commit string) (submodules []submodule, err error) {
+	if _, err := git(m.path, "cat-file", "-e", commit+":.gitmodules"); err != nil {
+		return nil, nil
+	}
+
+	output, err := git(m.path, "config", "--blob", commit+":.gitmodules", "--list")
+	if err != nil {
+		return nil, err
+	}
+
+	// Keys are submodule.<name>.<setting>, names can have dots in them
+	paths := make(map[string]string)
+	urls := make(map[string]string)
+	names := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		key, value, found := strings.Cut(line, "=")
+		if !found || !strings.HasPrefix(key, "submodule.") {
+			continue
+		}
+
+		i := strings.LastIndex(key, ".")
+		name, setting := key[len("submodule."):i], key[i+1:]
+		switch setting {
+		case "path":
+			paths[name] = value
+			names = append(names, name)
+		case "url":
+			urls[name] = value
+		}
+	}
+
+	for _, name := range names {
+		// Entries in .gitmodules that arent in the tree any more are skipped, like git submodule update does
+		entry, err := git(m.path, "ls-tree", commit, "--", paths[name])
+		if err != nil {
+			return nil, err
+		}
+		fields := strings.Fields(string(entry))
+		if len(fields) < 3 || fields[0] != "160000" {
+			continue
+		}
+
+		if len(urls[name]) == 0 {
+			return nil, fmt.Errorf("Submodule %s has no url", paths[name])
+		}
+
+		submodules = append(submodules, submodule{path: paths[name], repository: submoduleURL(m.repository, urls[name]), commit: fields[2]})
+	}
+
+	return submodules, nil
+}
+
+// submoduleURL resolves a relative submodule url (./ or ../) against the repository it is in, the way git does
+func submoduleURL(repository, url string) string {
+	if !strings.HasPrefix(url, "./") && !strings.HasPrefix(url, "../") {
+		return url
+	}
+
+	base := strings.TrimSuffix(repository, "/")
+	for {
+		switch {
+		case strings.HasPrefix(url, "./"):
+			url = url[2:]
+		case strings.HasPrefix(url, "../"):
+			url = url[3:]
+			if i := strings.LastIndexAny(base, "/:"); i != -1 && base[i] == ':' {
+				base = base[:i+1] // git@host:repo.git goes up to git@host:
+			} else if i != -1 {
+				base = base[:i]
+			}
+		default:
+			separator := "/"
+			if strings.HasSuffix(base, ":") {
+				separator = ""
+			}
+			return base + separator + url
+		}
+	}
+}
+
+// checkout makes a shallow checkout of commit in dir, then of its submodules from their own mirrors. refs are fetched
+// along with the commit. Without update nothing is fetched from upstream, so everything has to be in the mirrors already
+func (m gitMirror) checkout(dir, commit string, refs []string, update bool, vendorDirectories []string) error {
+	if !update && !m.has(commit) {
+		return offlineError(m.repository + " " + shortCommit(commit))
+	}
+
+	// origin points upstream rather than at the mirror, for anything in the build that looks at it
+	steps := [][]string{
+		{"init", "--quiet"},
+		{"remote", "add", "origin", m.repository},
+		append([]string{"fetch", "--quiet", "--depth", "1", m.path, commit}, refs...),
+		{"checkout", "--quiet", "--detach", commit},
+	}
+
+	for _, args := range steps {
+		if _, err := git(dir, args...); err != nil {
+			return err
+		}
+	}
+
+	submodules, err := m.submodules(commit)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range submodules {
+		sm, err := openGitMirror(s.repository, update, vendorDirectories...)
+		if err == nil {
+			err = os.MkdirAll(filepath.Join(dir, s.path), 0700)
+		}
+		if err == nil {
+			err = sm.checkout(filepath.Join(dir, s.path), s.commit, nil, update, vendorDirectories)
+		}
+		if err != nil {
+			return fmt.Errorf("Submodule %s: %s", s.path, err)
+		}
+	}
+
+	return nil
+}
+
+// checkoutGit makes a shallow checkout of the packages resolved commit in source/, including submodules
+// Without update the existing mirrors (or bundles of them in vendorDirectories) are used as is, which only works if they
+// already have the commits
+func checkoutGit(p Package, update bool, vendorDirectories ...string) (fetched fetchedSource, err error) {
+	m, err := openGitMirror(p.Repository, update, vendorDirectories...)
+	if err != nil {
+		return fetched, err
+	}
+
+	// Clone somewhere temporary so a failed clone never leaves a half finished tree where the package is expected to be
+	destination, err := ioutil.TempDir("source", "."+p.Name+"-clone-")
+	if err != nil {
+		return fetched, err
+	}
+	defer os.RemoveAll(destination)
+
+	refs := []string{}
+	if _, err := git(m.path, "rev-parse", "--verify", "--quiet", "refs/tags/"+p.Tag); err == nil {
+		// Bring the tag along so that git describe works in the checkout
+		refs = append(refs, "+refs/tags/"+p.Tag+":refs/tags/"+p.Tag)
+	}
+
+	if err := m.checkout(destination, p.Commit, refs, update, vendorDirectories); err != nil {
+		return fetched, err
+	}
+
+	if err := writeStamp(destination, p.stamp()); err != nil {
+		return fetched, err
+	}
+
+	fetched.Path, err = replaceSourceDirectory(destination, versionedSourceDirectory(p))
+	if err != nil {
+		return fetched, err
+	}
+
+	fetched.Tag = p.Tag
+	fetched.Commit = p.Commit
+	fetched.URL = p.Repository
+
+	return fetched, nil
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// gitEnvironment keeps the tests away from the users git configuration, and lets submodules use local paths
+func gitEnvironment(t *testing.T) {
+	t.Helper()
+
+	config := map[string]string{
+		"protocol.file.allow": "always",
+		"init.defaultBranch":  "main",
+		"advice.detachedHead": "false",
+	}
+
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("GIT_AUTHOR_NAME", "Test")
+	t.Setenv("GIT_AUTHOR_EMAIL", "test@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "Test")
+	t.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+	t.Setenv("GIT_CONFIG_COUNT", strconv.Itoa(len(config)))
+
+	i := 0
+	for key, value := range config {
+		t.Setenv("GIT_CONFIG_KEY_"+strconv.Itoa(i), key)
+		t.Setenv("GIT_CONFIG_VALUE_"+strconv.Itoa(i), value)
+		i++
+	}
+}
+
+// inDirectory runs the rest of the test in dir, as cache/ and source/ are relative to where the program is run
+func inDirectory(t *testing.T, dir string) {
+	t.Helper()
+
+	previous, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(previous) })
+}
+
+func mustGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+
+	output, err := git(dir, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// commitFile writes a file in a work tree, commits and pushes it, returning the commit
+func commitFile(t *testing.T, work, name, contents string) string {
+	t.Helper()
+
+	if err := ioutil.WriteFile(filepath.Join(work, name), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mustGit(t, work, "add", name)
+	mustGit(t, work, "commit", "--quiet", "-m", "Change "+name)
+	mustGit(t, work, "push", "--quiet", "origin", "main")
+
+	return mustGit(t, work, "rev-parse", "HEAD")
+}
+
+// bareRepository makes an empty bare repository and a clone of it to work in
+func bareRepository(t *testing.T, root, name string) (bare, work string) {
+	t.Helper()
+
+	bare = filepath.Join(root, name+".git")
+	work = filepath.Join(root, name)
+	mustGit(t, root, "init", "--quiet", "--bare", bare)
+	mustGit(t, root, "clone", "--quiet", bare, work)
+
+	return bare, work
+}
+
+func TestGitMirror(t *testing.T) {
+	gitEnvironment(t)
+	root := t.TempDir()
+
+	sub, subWork := bareRepository(t, root, "sub")
+	subCommit := commitFile(t, subWork, "sub.txt", "sub\n")
+
+	upstream, work := bareRepository(t, root, "upstream")
+	commitFile(t, work, "README", "one\n")
+
+	// Relative, so it has to be resolved against the upstream url
+	mustGit(t, work, "submodule", "--quiet", "add", "../sub.git", "lib/sub")
+	mustGit(t, work, "commit", "--quiet", "-m", "Add submodule")
+	tagged := mustGit(t, work, "rev-parse", "HEAD")
+	mustGit(t, work, "tag", "-a", "-m", "Release 1.0", "v1.0")
+
+	latest := commitFile(t, work, "README", "two\n")
+	mustGit(t, work, "tag", "v1.1")
+	mustGit(t, work, "push", "--quiet", "origin", "--tags")
+
+	build := filepath.Join(root, "build")
+	if err := os.MkdirAll(filepath.Join(build, "source"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	inDirectory(t, build)
+
+	if _, err := openGitMirror(upstream, false); err == nil || !strings.Contains(err.Error(), "offline") {
+		t.Fatalf("Opening a mirror that doesnt exist without updating should fail as offline, got %v", err)
+	}
+
+	m, err := openGitMirror(upstream, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags, err := m.Tags()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := make(map[string]string)
+	for _, tag := range tags {
+		found[tag.Name] = tag.Commit
+	}
+	if len(found) != 2 || found["v1.0"] != tagged || found["v1.1"] != latest {
+		t.Errorf("Tags should be v1.0 -> %s (peeled) and v1.1 -> %s, got %v", tagged, latest, found)
+	}
+
+	revisions := []struct {
+		revision string
+		commit   string
+	}{
+		{"v1.0", tagged},
+		{"v1.1", latest},
+		{"main", latest},
+		{tagged[:12], tagged},
+		{tagged, tagged},
+	}
+	for _, r := range revisions {
+		commit, err := m.Revision(r.revision)
+		if err != nil || commit != r.commit {
+			t.Errorf("Revision(%s) = %s, %v, want %s", r.revision, commit, err, r.commit)
+		}
+	}
+
+	if _, err := m.Revision("v9.9"); err == nil {
+		t.Errorf("Revision of a tag that doesnt exist should fail")
+	}
+
+	p := Package{Name: "upstream", Repository: upstream, SourceType: gitSource, Tag: "v1.0", Commit: tagged}
+
+	checkout := func(update bool) string {
+		t.Helper()
+
+		fetched, err := checkoutGit(p, update)
+		if err != nil {
+			t.Fatalf("checkoutGit(update=%v): %s", update, err)
+		}
+
+		if b, err := ioutil.ReadFile(filepath.Join(fetched.Path, "lib", "sub", "sub.txt")); err != nil || string(b) != "sub\n" {
+			t.Errorf("Submodule wasnt checked out: %q %v", b, err)
+		}
+		if head := mustGit(t, filepath.Join(fetched.Path, "lib", "sub"), "rev-parse", "HEAD"); head != subCommit {
+			t.Errorf("Submodule is at %s, want %s", head, subCommit)
+		}
+		if described := mustGit(t, fetched.Path, "describe", "--tags"); described != "v1.0" {
+			t.Errorf("The tag should come along with the checkout, git describe gave %s", described)
+		}
+		if stamp := readStamp(fetched.Path); stamp != tagged {
+			t.Errorf("Stamp is %s, want %s", stamp, tagged)
+		}
+
+		return fetched.Path
+	}
+
+	path := checkout(true)
+	if path != mustAbs(t, versionedSourceDirectory(p)) {
+		t.Errorf("Checked out to %s, want %s", path, versionedSourceDirectory(p))
+	}
+
+	// Without updating everything comes from the mirrors, including the submodule
+	if err := os.RemoveAll(path); err != nil {
+		t.Fatal(err)
+	}
+	checkout(false)
+
+	// A commit the mirror hasnt fetched yet cant be checked out without updating
+	newer := commitFile(t, work, "README", "three\n")
+	p.Tag, p.Commit = "main", newer
+	if _, err := checkoutGit(p, false); err == nil || !strings.Contains(err.Error(), "offline") {
+		t.Errorf("Checking out a commit that isnt in the mirror without updating should fail as offline, got %v", err)
+	}
+	if _, err := checkoutGit(p, true); err != nil {
+		t.Errorf("Updating should fetch the new commit: %s", err)
+	}
+
+	// Nor can a submodule whose mirror is missing
+	subMirror, err := openGitMirror(sub, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(subMirror.path); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Tag, p.Commit = "v1.0", tagged
+	_, err = checkoutGit(p, false)
+	if err == nil || !strings.Contains(err.Error(), "Submodule lib/sub") || !strings.Contains(err.Error(), "offline") {
+		t.Errorf("Checking out without the submodules mirror should fail as offline, got %v", err)
+	}
+
+	// Bundles in a vendor directory stand in for the mirrors, including the submodules
+	if _, err := openGitMirror(sub, true); err != nil {
+		t.Fatal(err)
+	}
+	bundles, err := m.bundle(tagged, "vendor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bundles) != 2 {
+		t.Errorf("Should have bundled the repository and its submodule, got %v", bundles)
+	}
+
+	if err := os.RemoveAll(filepath.Join("cache", "git")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkoutGit(p, false, "vendor"); err != nil {
+		t.Errorf("Checking out from vendored bundles: %s", err)
+	}
+
+	// And the mirrors made from them still update from upstream
+	newest := commitFile(t, work, "README", "four\n")
+	restored, err := openGitMirror(upstream, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !restored.has(newest) {
+		t.Errorf("A mirror restored from a bundle should fetch from upstream when updated")
+	}
+
+	// Nothing is left behind by the failed checkouts
+	entries, err := ioutil.ReadDir("source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			t.Errorf("Temporary checkout %s was left behind", entry.Name())
+		}
+	}
+}
+
+// Packages fetched in parallel can share a repository and a submodule, their mirrors are only cloned once
+func TestParallelGitFetch(t *testing.T) {
+	gitEnvironment(t)
+	root := t.TempDir()
+
+	_, subWork := bareRepository(t, root, "sub")
+	commitFile(t, subWork, "sub.txt", "sub\n")
+
+	upstream, work := bareRepository(t, root, "upstream")
+	mustGit(t, work, "submodule", "--quiet", "add", "../sub.git", "lib/sub")
+	commits := []string{commitFile(t, work, "README", "one\n")}
+	for _, contents := range []string{"two\n", "three\n", "four\n"} {
+		commits = append(commits, commitFile(t, work, "README", contents))
+	}
+
+	build := filepath.Join(root, "build")
+	if err := os.MkdirAll(filepath.Join(build, "source"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	inDirectory(t, build)
+
+	pending := []pendingFetch{}
+	for i, commit := range commits {
+		p := &Package{Name: "upstream" + strconv.Itoa(i), Repository: upstream, SourceType: gitSource, Tag: "main", Commit: commit}
+		pending = append(pending, pendingFetch{pkg: p, locked: lockedPackage{Tag: p.Tag, Commit: commit}, isLocked: true})
+	}
+
+	progress := startProgressReporter(ioutil.Discard, false)
+	fetched, err := fetchPackages(pending, pullOptions{Jobs: len(pending)}, progress)
+	progress.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, entry := range fetched {
+		if head := mustGit(t, entry.Path, "rev-parse", "HEAD"); head != commits[i] {
+			t.Errorf("%s is at %s, want %s", pending[i].pkg.Name, head, commits[i])
+		}
+		if !Exists(filepath.Join(entry.Path, "lib", "sub", "sub.txt")) {
+			t.Errorf("%s is missing its submodule", pending[i].pkg.Name)
+		}
+	}
+
+	mirrors, err := ioutil.ReadDir(filepath.Join("cache", "git"))
+	if err != nil || len(mirrors) != 2 {
+		t.Errorf("Should have one mirror of the repository and one of the submodule, got %d %v", len(mirrors), err)
+	}
+}
+
+func mustAbs(t *testing.T, path string) string {
+	t.Helper()
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return abs
+}
+
+func TestSubmoduleURL(t *testing.T) {
+	tests := []struct {
+		repository string
+		url        string
+		want       string
+	}{
+		{"https://github.com/owner/repo.git", "https://example.com/other.git", "https://example.com/other.git"},
+		{"https://github.com/owner/repo.git", "../other.git", "https://github.com/owner/other.git"},
+		{"https://github.com/owner/repo", "../../else/other", "https://github.com/else/other"},
+		{"https://github.com/owner/repo/", "./nested", "https://github.com/owner/repo/nested"},
+		{"git@github.com:owner/repo.git", "../other.git", "git@github.com:owner/other.git"},
+		{"git@github.com:owner/repo.git", "../../other.git", "git@github.com:other.git"},
+		{"/srv/git/repo.git", "../other.git", "/srv/git/other.git"},
+	}
+
+	for _, test := range tests {
+		if got := submoduleURL(test.repository, test.url); got != test.want {
+			t.Errorf("submoduleURL(%s, %s) = %s, want %s", test.repository, test.url, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/shurcooL/githubv4"
+)
+
+// remoteTag is a tag as published by a repository, along with the commit it points to
+type remoteTag struct {
+	Name   string
+	Commit string
+
+	Version   Version
+	IsVersion bool
+}
+
+// gitTarget is the object a ref points at. Lightweight tags and branches point directly at a commit
+// annotated tags point at a tag object, which then points at the commit
+type gitTarget struct {
+	Oid string
+	Tag struct {
+		Target struct {
+			Oid string
+		}
+	} `graphql:"... on Tag"`
+}
+
+func (t gitTarget) commit() string {
+	if len(t.Tag.Target.Oid) != 0 {
+		return t.Tag.Target.Oid
+	}
+	return t.Oid
+}
+
+func newGithubClient(graphqlURL string) *githubv4.Client {
+	return githubv4.NewEnterpriseClient(graphqlURL, apiClient())
+}
+
+// githubError adds the remaining rate limit budget to a failed api request, as running out is the usual reason
+func githubError(err error) error {
+	if summary := rateLimitSummary(); len(summary) != 0 {
+		return fmt.Errorf("%s (%s)", err, summary)
+	}
+	return err
+}
+
+// githubRepository splits a https://github.com/owner/repo url into its owner and repository name
+func githubRepository(repository string) (owner, name string, err error) {
+	u, err := url.Parse(repository)
+	if err != nil {
+		return "", "", err
+	}
+
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("Repository %s wasnt in the required https://github/owner/repo format", repository)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// tagSource is somewhere the tags and revisions of a package can be looked up
+type tagSource interface {
+	// Tags lists every tag
+	Tags() ([]remoteTag, error)
+	// Revision resolves a tag, branch or commit to a full commit hash
+	Revision(revision string) (commitHash string, err error)
+	String() string
+}
+
+// githubTags looks up tags with the github graphql api
+type githubTags struct {
+	client      *githubv4.Client
+	owner, name string
+}
+
+func (g githubTags) Tags() ([]remoteTag, error) {
+	return listTags(g.client, g.owner, g.name)
+}
+
+func (g githubTags) Revision(revision string) (string, error) {
+	return lookupRevision(g.client, g.owner, g.name, revision)
+}
+
+func (g githubTags) String() string {
+	return g.owner + "/" + g.name
+}
+
+const (
+	defaultArchiveHost   = "https://github.com"
+	defaultGithubAPI     = "https://api.github.com"
+	defaultGithubGraphQL = "https://api.github.com/graphql"
+)
+
+// githubEndpoints are where a packages github lives, so github enterprise (or something pretending to be github) can be used
+type githubEndpoints struct {
+	APIURL      string `json:"api_url"`      // Rest api, defaults to https://api.github.com or <archive_host>/api/v3
+	GraphQLURL  string `json:"graphql_url"`  // Defaults to https://api.github.com/graphql or <archive_host>/api/graphql
+	ArchiveHost string `json:"archive_host"` // Where archives are downloaded from, defaults to the scheme and host of repo
+}
+
+// setEndpoints fills in anything the package doesnt set from the pkg files global settings, and the rest from its repository
+func (p *Package) setEndpoints(global githubEndpoints) error {
+	if len(p.APIURL) == 0 {
+		p.APIURL = global.APIURL
+	}
+	if len(p.GraphQLURL) == 0 {
+		p.GraphQLURL = global.GraphQLURL
+	}
+	if len(p.ArchiveHost) == 0 {
+		p.ArchiveHost = global.ArchiveHost
+	}
+
+	// Trimmed before anything is derived from them, "https://ghe/" shouldnt give "https://ghe//api/v3"
+	for _, endpoint := range []*string{&p.APIURL, &p.GraphQLURL, &p.ArchiveHost} {
+		*endpoint = strings.TrimSuffix(*endpoint, "/")
+	}
+
+	if len(p.ArchiveHost) == 0 {
+		p.ArchiveHost = defaultArchiveHost
+		if u, err := url.Parse(p.Repository); err == nil && len(u.Host) != 0 {
+			p.ArchiveHost = u.Scheme + "://" + u.Host
+		}
+	}
+
+	if len(p.APIURL) == 0 {
+		p.APIURL = defaultGithubAPI
+		if p.ArchiveHost != defaultArchiveHost {
+			p.APIURL = p.ArchiveHost + "/api/v3"
+		}
+	}
+
+	if len(p.GraphQLURL) == 0 {
+		switch {
+		case p.APIURL == defaultGithubAPI:
+			p.GraphQLURL = defaultGithubGraphQL
+		case strings.HasSuffix(p.APIURL, "/api/v3"):
+			p.GraphQLURL = strings.TrimSuffix(p.APIURL, "/api/v3") + "/api/graphql"
+		default:
+			p.GraphQLURL = p.APIURL + "/graphql"
+		}
+	}
+
+	for _, endpoint := range []*string{&p.APIURL, &p.GraphQLURL, &p.ArchiveHost} {
+		u, err := url.Parse(*endpoint)
+		if err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 {
+			return fmt.Errorf("Package [%s] '%s' isnt a valid url", p.Name, *endpoint)
+		}
+	}
+
+	return nil
+}
+
+func hostOf(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+var unauthenticatedWarnings sync.Map
+
+func warnUnauthenticated(host string) {
+	if _, warned := unauthenticatedWarnings.LoadOrStore(host, true); !warned {
+		warnf("[WARN] No token for %s, using the unauthenticated api which github.com only allows 60 requests an hour\n", host)
+	}
+}
+
+// githubRESTTags looks up tags with the github rest api, which unlike graphql can be used without a token
+type githubRESTTags struct {
+	api         string
+	owner, name string
+}
+
+func (g githubRESTTags) url(path string) string {
+	return g.api + (&url.URL{Path: fmt.Sprintf("/repos/%s/%s/%s", g.owner, g.name, path)}).EscapedPath()
+}
+
+func (g githubRESTTags) get(u, accept string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", accept)
+
+	return apiClient().Do(req)
+}
+
+func (g githubRESTTags) Tags() (tags []remoteTag, err error) {
+	next := g.url("tags") + "?per_page=100"
+
+	for len(next) != 0 {
+		var page []struct {
+			Name   string
+			Commit struct {
+				Sha string
+			}
+		}
+
+		resp, err := g.get(next, "application/vnd.github+json")
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, githubError(fmt.Errorf("Listing tags of %s failed: %s", g, resp.Status))
+		}
+
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, tag := range page {
+			tags = append(tags, newRemoteTag(tag.Name, tag.Commit.Sha))
+		}
+
+		next = nextPage(resp.Header.Get("Link"))
+	}
+
+	return tags, nil
+}
+
+var nextPageRegex = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// nextPage finds the url of the next page in a Link header, or returns an empty string if this is the last one
+func nextPage(link string) string {
+	if m := nextPageRegex.FindStringSubmatch(link); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+func (g githubRESTTags) Revision(revision string) (string, error) {
+	candidates := []string{"tags/" + revision, "heads/" + revision}
+	if commitHashRegex.MatchString(revision) {
+		candidates = append(candidates, revision)
+	}
+
+	for _, candidate := range candidates {
+		// The sha media type gets just the commit hash back, with annotated tags already peeled
+		resp, err := g.get(g.url("commits/"+candidate), "application/vnd.github.sha")
+		if err != nil {
+			return "", err
+		}
+
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		if err != nil {
+			return "", err
+		}
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return strings.TrimSpace(string(body)), nil
+		case http.StatusNotFound, http.StatusUnprocessableEntity:
+			continue
+		}
+
+		return "", githubError(fmt.Errorf("Looking up %s in %s failed: %s", revision, g, resp.Status))
+	}
+
+	return "", fmt.Errorf("Version '%s' is not a tag, branch or commit in %s", revision, g)
+}
+
+func (g githubRESTTags) String() string {
+	return g.owner + "/" + g.name
+}
+
+// listTags pages through every tag in the repository
+func listTags(client *githubv4.Client, owner, name string) (tags []remoteTag, err error) {
+
+	var query struct {
+		Repository struct {
+			Refs struct {
+				PageInfo struct {
+					HasNextPage bool
+					EndCursor   githubv4.String
+				}
+				Nodes []struct {
+					Name   string
+					Target gitTarget
+				}
+			} `graphql:"refs(refPrefix: \"refs/tags/\", first: 100, after: $cursor)"`
+		} `graphql:"repository(owner: $repoOwner, name: $repoName)"`
+	}
+
+	variables := map[string]interface{}{
+		"repoOwner": githubv4.String(owner),
+		"repoName":  githubv4.String(name),
+		"cursor":    (*githubv4.String)(nil),
+	}
+
+	for {
+		err = client.Query(context.Background(), &query, variables)
+		if err != nil {
+			return nil, githubError(err)
+		}
+
+		for _, node := range query.Repository.Refs.Nodes {
+			tags = append(tags, newRemoteTag(node.Name, node.Target.commit()))
+		}
+
+		if !query.Repository.Refs.PageInfo.HasNextPage {
+			break
+		}
+
+		variables["cursor"] = githubv4.NewString(query.Repository.Refs.PageInfo.EndCursor)
+	}
+
+	return tags, nil
+}
+
+func newRemoteTag(name, commit string) remoteTag {
+	v, ok := parseVersion(name)
+	return remoteTag{
+		Name:      name,
+		Commit:    commit,
+		Version:   v,
+		IsVersion: ok,
+	}
+}
+
+var commitHashRegex = regexp.MustCompile(`^[0-9a-fA-F]{7,40}$`)
+
+// lookupRevision resolves a single tag, branch or commit (in that order) to its full commit hash
+func lookupRevision(client *githubv4.Client, owner, name, revision string) (commitHash string, err error) {
+
+	var query struct {
+		Repository struct {
+			Tag struct {
+				Target gitTarget
+			} `graphql:"tag: ref(qualifiedName: $tagRef)"`
+			Branch struct {
+				Target gitTarget
+			} `graphql:"branch: ref(qualifiedName: $branchRef)"`
+			Object struct {
+				Commit struct {
+					Oid string
+				} `graphql:"... on Commit"`
+			} `graphql:"object(expression: $revision)"`
+		} `graphql:"repository(owner: $repoOwner, name: $repoName)"`
+	}
+
+	variables := map[string]interface{}{
+		"repoOwner": githubv4.String(owner),
+		"repoName":  githubv4.String(name),
+		"tagRef":    githubv4.String("refs/tags/" + revision),
+		"branchRef": githubv4.String("refs/heads/" + revision),
+		"revision":  githubv4.String(revision),
+	}
+
+	err = client.Query(context.Background(), &query, variables)
+	if err != nil {
+		return "", githubError(err)
+	}
+
+	switch {
+	case len(query.Repository.Tag.Target.commit()) != 0:
+		return query.Repository.Tag.Target.commit(), nil
+	case len(query.Repository.Branch.Target.commit()) != 0:
+		return query.Repository.Branch.Target.commit(), nil
+	case commitHashRegex.MatchString(revision) && len(query.Repository.Object.Commit.Oid) != 0:
+		return query.Repository.Object.Commit.Oid, nil
+	}
+
+	return "", fmt.Errorf("Version '%s' is not a tag, branch or commit in %s/%s", revision, owner, name)
+}
+
+// resolveVersion picks the tag and commit described by a packages version field
+// Either a version constraint like ">=1.2.11 <1.3", which selects the newest matching tag, or an exact tag, branch or commit
+func resolveVersion(source tagSource, version, tagRegex string) (tagName, commitHash string, err error) {
+
+	if !isVersionConstraint(version) {
+		commitHash, err = source.Revision(version)
+		return version, commitHash, err
+	}
+
+	constraint, err := parseVersionConstraint(version)
+	if err != nil {
+		return "", "", err
+	}
+
+	tags, err := source.Tags()
+	if err != nil {
+		return "", "", err
+	}
+
+	newest, err := selectTag(tags, &constraint, tagRegex)
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %s", source, err)
+	}
+
+	return newest.Name, newest.Commit, nil
+}
+
+// getLatestPackage finds the newest tag in a repository, optionally limited to tags matching a regex
+func getLatestPackage(source tagSource, regex string) (tagName string, commitHash string, err error) {
+
+	tags, err := source.Tags()
+	if err != nil {
+		return "", "", err
+	}
+
+	newest, err := selectTag(tags, nil, regex)
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %s", source, err)
+	}
+
+	return newest.Name, newest.Commit, nil
+}
+
+// selectTag picks the newest tag by version out of every tag that satisfies the constraint and regex (either may be empty)
+// Pre releases are left out unless the constraint or regex names one, like ">=3.0.0-beta1" or "-rc[0-9]+$"
+// When nothing matches the error lists the tags that were considered, as a typo in a regex is by far the most common cause
+func selectTag(tags []remoteTag, constraint *VersionConstraint, tagRegex string) (newest remoteTag, err error) {
+	if len(tags) == 0 {
+		return newest, fmt.Errorf("Repository has no tags")
+	}
+
+	var reg *regexp.Regexp
+	if len(tagRegex) != 0 {
+		reg, err = regexp.Compile(tagRegex)
+		if err != nil {
+			return newest, err
+		}
+	}
+
+	preReleases := (constraint != nil && constraint.namesPreRelease()) || namesPreRelease(tagRegex)
+	skippedPreReleases := false
+
+	sorted := make([]remoteTag, len(tags))
+	copy(sorted, tags)
+	sortTags(sorted)
+
+	for i := len(sorted) - 1; i >= 0; i-- {
+		tag := sorted[i]
+
+		if reg != nil && !reg.MatchString(tag.Name) {
+			continue
+		}
+
+		if tag.IsVersion && tag.Version.PreRank != 0 && !preReleases {
+			skippedPreReleases = true
+			continue
+		}
+
+		if constraint != nil && (!tag.IsVersion || !constraint.Matches(tag.Version)) {
+			continue
+		}
+
+		return tag, nil
+	}
+
+	var wanted []string
+	if reg != nil {
+		wanted = append(wanted, fmt.Sprintf("regex '%s'", tagRegex))
+	}
+	if constraint != nil {
+		wanted = append(wanted, fmt.Sprintf("version '%s'", constraint))
+	}
+
+	problem := "No tags match " + strings.Join(wanted, " and ")
+	if len(wanted) == 0 {
+		problem = "No tags are releases"
+	}
+	if skippedPreReleases {
+		problem += " (pre releases are only used when the version or tag_regex names one)"
+	}
+
+	return newest, fmt.Errorf("%s, saw %d tags: %s", problem, len(sorted), summariseTags(sorted))
+}
+
+// summariseTags lists the newest tags, newest first, leaving out the rest of a potentially very long list
+func summariseTags(sorted []remoteTag) string {
+	const shown = 20
+
+	var names []string
+	for i := len(sorted) - 1; i >= 0 && len(names) < shown; i-- {
+		names = append(names, sorted[i].Name)
+	}
+
+	summary := strings.Join(names, ", ")
+	if len(sorted) > shown {
+		summary += fmt.Sprintf(" (and %d older)", len(sorted)-shown)
+	}
+
+	return summary
+}
+
+// sortTags orders tags oldest to newest by version, tags that arent versions go first
+func sortTags(tags []remoteTag) {
+	sort.SliceStable(tags, func(i, j int) bool {
+		if tags[i].IsVersion != tags[j].IsVersion {
+			return !tags[i].IsVersion
+		}
+
+		if !tags[i].IsVersion {
+			return strings.Compare(tags[i].Name, tags[j].Name) < 0
+		}
+
+		return tags[i].Version.Compare(tags[j].Version) < 0
+	})
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSetEndpoints(t *testing.T) {
+	tests := []struct {
+		repository string
+		global     githubEndpoints
+		own        githubEndpoints
+		want       githubEndpoints
+	}{
+		{
+			repository: "https://github.com/madler/zlib",
+			want:       githubEndpoints{APIURL: "https://api.github.com", GraphQLURL: "https://api.github.com/graphql", ArchiveHost: "https://github.com"},
+		},
+		{
+			repository: "https://github.example.com/team/tool",
+			want:       githubEndpoints{APIURL: "https://github.example.com/api/v3", GraphQLURL: "https://github.example.com/api/graphql", ArchiveHost: "https://github.example.com"},
+		},
+		{
+			repository: "https://github.com/madler/zlib",
+			global:     githubEndpoints{ArchiveHost: "http://127.0.0.1:8080/"},
+			want:       githubEndpoints{APIURL: "http://127.0.0.1:8080/api/v3", GraphQLURL: "http://127.0.0.1:8080/api/graphql", ArchiveHost: "http://127.0.0.1:8080"},
+		},
+		{
+			repository: "https://github.example.com/team/tool",
+			global:     githubEndpoints{APIURL: "https://api.example.com/rest/"},
+			want:       githubEndpoints{APIURL: "https://api.example.com/rest", GraphQLURL: "https://api.example.com/rest/graphql", ArchiveHost: "https://github.example.com"},
+		},
+		{
+			// A packages own settings win over the global ones
+			repository: "https://github.com/madler/zlib",
+			global:     githubEndpoints{APIURL: "https://global.example.com/api/v3"},
+			own:        githubEndpoints{APIURL: "https://own.example.com/api/v3", GraphQLURL: "https://own.example.com/graphql"},
+			want:       githubEndpoints{APIURL: "https://own.example.com/api/v3", GraphQLURL: "https://own.example.com/graphql", ArchiveHost: "https://github.com"},
+		},
+	}
+
+	for _, test := range tests {
+		p := Package{Name: "test", Repository: test.repository, githubEndpoints: test.own}
+		if err := p.setEndpoints(test.global); err != nil {
+			t.Errorf("%s: %s", test.repository, err)
+			continue
+		}
+
+		if p.githubEndpoints != test.want {
+			t.Errorf("%s with %+v: got %+v, want %+v", test.repository, test.global, p.githubEndpoints, test.want)
+		}
+	}
+
+	p := Package{Name: "test", Repository: "https://github.com/madler/zlib", githubEndpoints: githubEndpoints{APIURL: "api.example.com"}}
+	if err := p.setEndpoints(githubEndpoints{}); err == nil {
+		t.Errorf("An api_url without a scheme should be refused")
+	}
+}
+
+// fakeGithub serves tags, two to a page, over both apis, and archives of any commit
+func fakeGithub(t *testing.T) *httptest.Server {
+	pages := [][]struct{ name, commit, tagObject string }{
+		{{"v1.0", "c10", ""}, {"v1.1", "c11", "t11"}},
+		{{"v2.0", "c20", "t20"}},
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/api/v3/repos/owner/tool/tags", func(w http.ResponseWriter, r *http.Request) {
+		page := 0
+		fmt.Sscan(r.URL.Query().Get("page"), &page)
+
+		if page+1 < len(pages) {
+			next := fmt.Sprintf("http://%s/api/v3/repos/owner/tool/tags?page=%d", r.Host, page+1)
+			w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next", <%s>; rel="last"`, next, next))
+		}
+
+		tags := []interface{}{}
+		for _, tag := range pages[page] {
+			tags = append(tags, map[string]interface{}{"name": tag.name, "commit": map[string]string{"sha": tag.commit}})
+		}
+		json.NewEncoder(w).Encode(tags)
+	})
+
+	mux.HandleFunc("/api/graphql", func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Variables struct {
+				Cursor *string `json:"cursor"`
+			} `json:"variables"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		page := 0
+		if request.Variables.Cursor != nil {
+			fmt.Sscan(*request.Variables.Cursor, &page)
+		}
+
+		nodes := []interface{}{}
+		for _, tag := range pages[page] {
+			target := map[string]interface{}{"oid": tag.commit}
+			if len(tag.tagObject) != 0 {
+				target = map[string]interface{}{"oid": tag.tagObject, "target": map[string]string{"oid": tag.commit}}
+			}
+			nodes = append(nodes, map[string]interface{}{"name": tag.name, "target": target})
+		}
+
+		refs := map[string]interface{}{
+			"pageInfo": map[string]interface{}{"hasNextPage": page+1 < len(pages), "endCursor": fmt.Sprint(page + 1)},
+			"nodes":    nodes,
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"repository": map[string]interface{}{"refs": refs}}})
+	})
+
+	mux.HandleFunc("/owner/tool/archive/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "archive of "+r.URL.Path)
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestGithubEndpoints(t *testing.T) {
+	server := fakeGithub(t)
+
+	// Like a github enterprise host, the apis are found from where the repository is
+	p := Package{Name: "tool", Repository: server.URL + "/owner/tool", SourceType: githubSource}
+	if err := p.setEndpoints(githubEndpoints{}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"v1.0": "c10", "v1.1": "c11", "v2.0": "c20"}
+
+	sources := []tagSource{
+		githubRESTTags{api: p.APIURL, owner: "owner", name: "tool"},
+		githubTags{client: newGithubClient(p.GraphQLURL), owner: "owner", name: "tool"},
+	}
+
+	for _, source := range sources {
+		tags, err := source.Tags()
+		if err != nil {
+			t.Errorf("%T: %s", source, err)
+			continue
+		}
+
+		found := make(map[string]string)
+		for _, tag := range tags {
+			found[tag.Name] = tag.Commit
+		}
+		if fmt.Sprint(found) != fmt.Sprint(want) {
+			t.Errorf("%T should page through every tag and peel annotated ones, got %v want %v", source, found, want)
+		}
+	}
+
+	inDirectory(t, t.TempDir())
+	for _, dir := range []string{"source", "cache"} {
+		if err := os.Mkdir(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p.Tag, p.Commit = "v2.0", "c20"
+	fetched, err := fetch(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fetched.URL != server.URL+"/owner/tool/archive/c20.tar.gz" {
+		t.Errorf("Archive should come from the archive host, got %s", fetched.URL)
+	}
+	if b, err := ioutil.ReadFile(fetched.Path); err != nil || string(b) != "archive of /owner/tool/archive/c20.tar.gz" {
+		t.Errorf("Downloaded archive is %q %v", b, err)
+	}
+	if filepath.Dir(fetched.Path) != filepath.Join(mustAbs(t, "."), "source") {
+		t.Errorf("Archive downloaded to %s", fetched.Path)
+	}
+}
+
+func TestNextPage(t *testing.T) {
+	tests := []struct {
+		link string
+		want string
+	}{
+		{`<https://api.github.com/repositories/1/tags?page=2>; rel="next", <https://api.github.com/repositories/1/tags?page=5>; rel="last"`, "https://api.github.com/repositories/1/tags?page=2"},
+		{`<https://api.github.com/repositories/1/tags?page=4>; rel="prev", <https://api.github.com/repositories/1/tags?page=1>; rel="first"`, ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if got := nextPage(test.link); got != test.want {
+			t.Errorf("nextPage(%s) = %s, want %s", test.link, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// Files in an included directory are package definitions on their own, any other files are ignored
+var packageExtensions = map[string]bool{".json": true, ".yaml": true, ".yml": true, ".toml": true}
+
+// manifestOrigin is where a value in a merged pkg file came from
+type manifestOrigin struct {
+	index *manifestIndex
+	path  string
+}
+
+// manifestMerger puts a pkg file together with everything it includes. Objects are merged key by key with the including
+// file winning, packages are merged by name, and anything else (strings, numbers, lists and nulls) replaces what was there
+type manifestMerger struct {
+	keys      map[*orderedObject]map[string]manifestOrigin // Where each key of each object came from
+	objects   map[*orderedObject]manifestOrigin            // Where objects themselves came from, for packages in a list
+	library   map[string]*orderedObject                    // Packages from included directories, only used when something needs them
+	including []string                                     // Files being read, to catch includes that go round in a circle
+	problems  []manifestProblem
+}
+
+// readManifest reads a pkg file along with everything it includes. idx is of the pkg file itself, and knows where
+// every value that came from an included file is
+func readManifest(file string) (settings pkgManifest, idx manifestIndex, problems []manifestProblem, err error) {
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return settings, idx, nil, err
+	}
+
+	settings, idx, problems, err = decodeManifest(file, contents)
+	if err != nil || len(settings.Include) == 0 {
+		return settings, idx, problems, err
+	}
+
+	m := manifestMerger{
+		keys:    make(map[*orderedObject]map[string]manifestOrigin),
+		objects: make(map[*orderedObject]manifestOrigin),
+		library: make(map[string]*orderedObject),
+	}
+
+	// Includes with problems are left out and the rest merged anyway, so everything can be checked in one go
+	doc, err := m.manifest(file, contents, &idx, false)
+	if err != nil {
+		return settings, idx, nil, err
+	}
+	m.useLibrary(doc)
+
+	merged, err := marshalDocument(doc, jsonFormat)
+	if err != nil {
+		return settings, idx, nil, err
+	}
+
+	idx.origins = make(map[string]manifestOrigin)
+	m.origins(doc, "", idx.origins)
+
+	// Included files with problems were left out, so this finds the pkg files own problems again (at the same places)
+	// along with any that come from putting everything together
+	settings, _, problems, err = decodeManifest("merged.json", merged)
+	for i, p := range problems {
+		problems[i] = idx.problem(p.warning, p.path, "%s", p.message)
+	}
+
+	return settings, idx, append(m.problems, problems...), err
+}
+
+// manifest merges a pkg file over what it includes, included is false for the pkg file being read
+func (m *manifestMerger) manifest(file string, contents []byte, idx *manifestIndex, included bool) (*orderedObject, error) {
+	doc, err := m.document(file, contents, idx, reflect.TypeOf(pkgManifest{}))
+	if err != nil {
+		return nil, err
+	}
+
+	if included {
+		rebaseManifest(doc, filepath.Dir(file))
+	}
+
+	absolute, err := filepath.Abs(file)
+	if err != nil {
+		return nil, err
+	}
+	m.including = append(m.including, absolute)
+	defer func() {
+		m.including = m.including[:len(m.including)-1]
+	}()
+
+	merged := newOrderedObject()
+
+	includes, _ := doc.values["include"].([]interface{})
+	for i, include := range includes {
+		path, _ := include.(string)
+		if err := m.include(merged, filepath.Dir(file), path, idx, fmt.Sprintf("include[%d]", i)); err != nil {
+			return nil, err
+		}
+	}
+	doc.remove("include")
+
+	m.merge(merged, doc)
+	return merged, nil
+}
+
+// include merges a pkg file into merged, or adds a directory of packages to the library. from is the file including it
+func (m *manifestMerger) include(merged *orderedObject, dir, include string, from *manifestIndex, path string) error {
+	report := func(format string, args ...interface{}) {
+		m.problems = append(m.problems, manifestProblem{path: path, offset: from.position(path), message: fmt.Sprintf(format, args...), in: from})
+	}
+
+	if len(include) == 0 {
+		report("include is empty")
+		return nil
+	}
+
+	// Relative to the file it is in, not to where the program is run
+	if !filepath.IsAbs(include) {
+		include = filepath.Join(dir, include)
+	}
+
+	info, err := os.Stat(include)
+	if err != nil {
+		report("%s doesnt exist", include)
+		return nil
+	}
+
+	if info.IsDir() {
+		return m.directory(include)
+	}
+
+	absolute, err := filepath.Abs(include)
+	if err != nil {
+		return err
+	}
+	for i, file := range m.including {
+		if file == absolute {
+			report("includes go round in a circle: %s -> %s", strings.Join(m.including[i:], " -> "), absolute)
+			return nil
+		}
+	}
+
+	contents, err := ioutil.ReadFile(include)
+	if err != nil {
+		return err
+	}
+
+	_, idx, problems, err := decodeManifest(include, contents)
+	if err != nil {
+		return err
+	}
+	if len(problems) != 0 {
+		m.reportAll(problems, &idx)
+		return nil
+	}
+
+	doc, err := m.manifest(include, contents, &idx, true)
+	if err != nil {
+		return err
+	}
+
+	m.merge(merged, doc)
+	return nil
+}
+
+// directory adds every package definition in a directory to the library, in file name order
+func (m *manifestMerger) directory(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !packageExtensions[strings.ToLower(filepath.Ext(entry.Name()))] {
+			continue
+		}
+
+		file := filepath.Join(dir, entry.Name())
+		contents, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		var pkg Package
+		idx, problems, err := decodeDocument(file, contents, &pkg)
+		if err != nil {
+			return err
+		}
+		if len(problems) != 0 {
+			m.reportAll(problems, &idx)
+			continue
+		}
+
+		doc, err := m.document(file, contents, &idx, reflect.TypeOf(pkg))
+		if err != nil {
+			return err
+		}
+		rebasePackage(doc, dir)
+
+		// A package without a name is named after its file, zlib.yaml is zlib
+		name := pkg.Name
+		if len(name) == 0 {
+			name = strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+			doc.set("name", name)
+			m.keys[doc]["name"] = manifestOrigin{index: &idx}
+		}
+
+		definition, ok := m.library[name]
+		if !ok {
+			definition = newOrderedObject()
+			m.library[name] = definition
+		}
+		m.merge(definition, doc)
+	}
+
+	return nil
+}
+
+func (m *manifestMerger) reportAll(problems []manifestProblem, idx *manifestIndex) {
+	for _, p := range problems {
+		p.in = idx
+		m.problems = append(m.problems, p)
+	}
+}
+
+// document parses a file that has already been decoded, and records where everything in it is
+func (m *manifestMerger) document(file string, contents []byte, idx *manifestIndex, t reflect.Type) (*orderedObject, error) {
+	doc, _, err := parseManifest(file, contents, manifestFormat(file, contents), t)
+	if err != nil {
+		return nil, err
+	}
+
+	object, ok := doc.(*orderedObject)
+	if !ok {
+		object = newOrderedObject() // An empty file, or just null
+	}
+
+	m.objects[object] = manifestOrigin{index: idx}
+	m.record(object, idx, "")
+	return object, nil
+}
+
+func (m *manifestMerger) record(value interface{}, idx *manifestIndex, path string) {
+	switch v := value.(type) {
+	case *orderedObject:
+		m.keys[v] = make(map[string]manifestOrigin)
+		for _, key := range v.keys {
+			m.keys[v][key] = manifestOrigin{index: idx, path: joinPath(path, key)}
+			m.record(v.values[key], idx, joinPath(path, key))
+		}
+	case []interface{}:
+		for i, item := range v {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+			if object, ok := item.(*orderedObject); ok {
+				m.objects[object] = manifestOrigin{index: idx, path: itemPath}
+			}
+			m.record(item, idx, itemPath)
+		}
+	}
+}
+
+// merge puts over on top of base. Objects are copied rather than shared, so merging into one later doesnt change the
+// file it came from
+func (m *manifestMerger) merge(base, over *orderedObject) {
+	if origin, ok := m.objects[over]; ok {
+		m.objects[base] = origin
+	}
+	if m.keys[base] == nil {
+		m.keys[base] = make(map[string]manifestOrigin)
+	}
+
+	for _, key := range over.keys {
+		m.keys[base][key] = m.keys[over][key]
+
+		switch value := over.values[key].(type) {
+		case *orderedObject:
+			object, ok := base.values[key].(*orderedObject)
+			if !ok {
+				object = newOrderedObject()
+			}
+			m.merge(object, value)
+			base.set(key, object)
+
+		case []interface{}:
+			// Only the pkg file itself has a list of objects
+			if key == "packages" {
+				packages, _ := base.values[key].([]interface{})
+				base.set(key, m.mergePackages(packages, value))
+				continue
+			}
+			base.set(key, value)
+
+		default:
+			base.set(key, value)
+		}
+	}
+}
+
+// mergePackages merges packages into the ones with the same name, and adds the rest after them
+func (m *manifestMerger) mergePackages(base, over []interface{}) []interface{} {
+	merged := append([]interface{}{}, base...)
+
+	for _, item := range over {
+		pkg, ok := item.(*orderedObject)
+		if !ok {
+			merged = append(merged, item)
+			continue
+		}
+
+		// Only looking at the packages from before, two with the same name in one file is left for validate to report
+		name, _ := pkg.values["name"].(string)
+		if i := packageIndex(merged[:len(base)], name); len(name) != 0 && i != -1 {
+			m.merge(merged[i].(*orderedObject), pkg)
+			continue
+		}
+
+		object := newOrderedObject()
+		m.merge(object, pkg)
+		merged = append(merged, object)
+	}
+
+	return merged
+}
+
+func packageIndex(packages []interface{}, name string) int {
+	for i, item := range packages {
+		if pkg, ok := item.(*orderedObject); ok && pkg.values["name"] == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// useLibrary puts library definitions under the packages named after them, and adds the library packages they depend on
+func (m *manifestMerger) useLibrary(doc *orderedObject) {
+	if len(m.library) == 0 {
+		return
+	}
+
+	packages, _ := doc.values["packages"].([]interface{})
+
+	listed := make(map[string]bool)
+	for _, item := range packages {
+		if pkg, ok := item.(*orderedObject); ok {
+			name, _ := pkg.values["name"].(string)
+			listed[name] = true
+		}
+	}
+
+	// Packages added for their dependents are at the end, so get their own dependencies added too
+	for i := 0; i < len(packages); i++ {
+		pkg, ok := packages[i].(*orderedObject)
+		if !ok {
+			continue
+		}
+
+		name, _ := pkg.values["name"].(string)
+		if definition, ok := m.library[name]; ok {
+			object := newOrderedObject()
+			m.merge(object, definition)
+			if pkg != definition {
+				m.merge(object, pkg)
+			}
+			packages[i], pkg = object, object
+		}
+
+		depends, _ := pkg.values["depends"].([]interface{})
+		for _, dependency := range depends {
+			dependency, _ := dependency.(string)
+			if definition, ok := m.library[dependency]; ok && !listed[dependency] {
+				listed[dependency] = true
+				packages = append(packages, definition)
+			}
+		}
+	}
+
+	doc.set("packages", packages)
+}
+
+// origins lists where every path in the merged pkg file came from
+func (m *manifestMerger) origins(value interface{}, path string, origins map[string]manifestOrigin) {
+	switch v := value.(type) {
+	case *orderedObject:
+		for _, key := range v.keys {
+			if origin, ok := m.keys[v][key]; ok {
+				origins[joinPath(path, key)] = origin
+			}
+			m.origins(v.values[key], joinPath(path, key), origins)
+		}
+	case []interface{}:
+		for i, item := range v {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+			if object, ok := item.(*orderedObject); ok {
+				if origin, ok := m.objects[object]; ok {
+					origins[itemPath] = origin
+				}
+			}
+			m.origins(item, itemPath, origins)
+		}
+	}
+}
+
+// Paths in an included file are relative to where it is, these make them relative to where the program is run like the
+// ones in the pkg file itself
+func rebaseManifest(doc *orderedObject, dir string) {
+	rebasePath(doc, "mirror_directory", dir)
+
+	if image, ok := doc.values["image_settings"].(*orderedObject); ok {
+		rebasePath(image, "image_config", dir)
+	}
+
+	packages, _ := doc.values["packages"].([]interface{})
+	for _, item := range packages {
+		if pkg, ok := item.(*orderedObject); ok {
+			rebasePackage(pkg, dir)
+		}
+	}
+}
+
+func rebasePackage(pkg *orderedObject, dir string) {
+	for _, key := range []string{"path", "source_directory", "patches", "mirror_directory"} {
+		rebasePath(pkg, key, dir)
+	}
+
+	if patchSets, ok := pkg.values["patch_sets"].(*orderedObject); ok {
+		for _, regex := range patchSets.keys {
+			rebasePath(patchSets, regex, dir)
+		}
+	}
+
+	if signature, ok := pkg.values["signature"].(*orderedObject); ok {
+		keys, _ := signature.values["keys"].([]interface{})
+		for i, key := range keys {
+			if key, ok := key.(string); ok {
+				keys[i] = rebase(key, dir)
+			}
+		}
+	}
+}
+
+func rebasePath(object *orderedObject, key, dir string) {
+	if path, ok := object.values[key].(string); ok {
+		object.values[key] = rebase(path, dir)
+	}
+}
+
+// Absolute paths and ones that start with a $replacement$ are left alone
+func rebase(path, dir string) string {
+	if len(path) == 0 || filepath.IsAbs(path) || strings.HasPrefix(path, "$") {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
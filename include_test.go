@@ -0,0 +1,158 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIncludes(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string // The pkg file read is product/main.json
+		check func(settings pkgManifest) string
+		want  string // What check returns, or the start of the problems reported
+	}{
+		{
+			name: "including file wins, objects merge key by key",
+			files: map[string]string{
+				"common/base.json":  `{"cross_compiler": "gcc", "image_settings": {"image_name": "base.sqfs", "executables": ["a", "b"]}}`,
+				"product/main.json": `{"include": ["../common/base.json"], "image_settings": {"image_name": "router.sqfs"}}`,
+			},
+			check: func(s pkgManifest) string {
+				return s.CrossCompiler + " " + s.ImageSettings.Filename + " " + strings.Join(s.ImageSettings.KeyExecutables, ",")
+			},
+			want: "gcc router.sqfs a,b",
+		},
+		{
+			name: "lists replace, null goes back to the default",
+			files: map[string]string{
+				"common/base.json":  `{"mirrors": ["a", "b"], "packages": [{"name": "zlib", "repo": "madler/zlib", "build": "make zlib"}]}`,
+				"product/main.json": `{"include": ["../common/base.json"], "mirrors": ["c"], "packages": [{"name": "zlib", "build": null}]}`,
+			},
+			check: func(s pkgManifest) string {
+				return strings.Join(s.Mirrors, ",") + " " + s.Packages[0].Repository + " '" + s.Packages[0].Build + "'"
+			},
+			want: "c madler/zlib ''",
+		},
+		{
+			name: "packages merge by name, new ones go after",
+			files: map[string]string{
+				"common/base.json":  `{"packages": [{"name": "zlib", "repo": "madler/zlib", "version": "1.3"}, {"name": "openssl", "repo": "openssl/openssl"}]}`,
+				"product/main.json": `{"include": ["../common/base.json"], "packages": [{"name": "openssh", "repo": "openssh/openssh-portable"}, {"name": "zlib", "version": "1.3.1"}]}`,
+			},
+			check: func(s pkgManifest) string {
+				names := []string{}
+				for _, p := range s.Packages {
+					names = append(names, p.Name+"@"+p.Version)
+				}
+				return strings.Join(names, " ")
+			},
+			want: "zlib@1.3.1 openssl@ openssh@",
+		},
+		{
+			name: "later includes win over earlier ones, includes nest relative to their own file",
+			files: map[string]string{
+				"common/first.json":           `{"cross_compiler": "first", "keep_old_sources": true}`,
+				"common/second.json":          `{"include": ["nested/compiler.yaml"]}`,
+				"common/nested/compiler.yaml": "cross_compiler: nested\n",
+				"product/main.json":           `{"include": ["../common/first.json", "../common/second.json"]}`,
+			},
+			check: func(s pkgManifest) string {
+				if !s.KeepOldSources {
+					return "keep_old_sources was lost"
+				}
+				return s.CrossCompiler
+			},
+			want: "nested",
+		},
+		{
+			name: "paths are rebased onto the file they are in",
+			files: map[string]string{
+				"common/base.toml":  "mirror_directory = \"mirror\"\n\n[[packages]]\nname = \"local\"\nsource_type = \"path\"\npath = \"src\"\npatches = \"$ROOT$/patches\"\nmirror_directory = \"/srv/mirror\"\n",
+				"product/main.json": `{"include": ["../common/base.toml"], "packages": [{"name": "local", "source_directory": "here"}]}`,
+			},
+			check: func(s pkgManifest) string {
+				p := s.Packages[0]
+				return strings.Join([]string{s.MirrorDirectory, p.Path, p.Patches, p.MirrorDirectory, p.Source}, " ")
+			},
+			want: "common/mirror common/src $ROOT$/patches /srv/mirror here",
+		},
+		{
+			name: "directories are a library of the packages listed and their dependencies",
+			files: map[string]string{
+				"common/packages/zlib.yaml":    "repo: madler/zlib\nversion: '1.3'\n",
+				"common/packages/openssl.json": `{"repo": "openssl/openssl", "depends": ["zlib"]}`,
+				"common/packages/unused.json":  `{"repo": "someone/unused"}`,
+				"common/packages/README.md":    "Not a package",
+				"product/main.json":            `{"include": ["../common/packages"], "packages": [{"name": "openssl", "version": "3.0"}]}`,
+			},
+			check: func(s pkgManifest) string {
+				names := []string{}
+				for _, p := range s.Packages {
+					names = append(names, p.Name+"@"+p.Version+":"+p.Repository)
+				}
+				return strings.Join(names, " ")
+			},
+			want: "openssl@3.0:openssl/openssl zlib@1.3:madler/zlib",
+		},
+		{
+			name: "circle",
+			files: map[string]string{
+				"common/a.json":     `{"include": ["b.json"]}`,
+				"common/b.json":     "{\n  \"include\": [\"a.json\"]\n}",
+				"product/main.json": `{"include": ["../common/a.json"]}`,
+			},
+			want: "common/b.json:2:15: error: include[0]: includes go round in a circle",
+		},
+		{
+			name: "missing include",
+			files: map[string]string{
+				"product/main.json": "{\n  \"include\": [\n    \"../common/missing.json\"\n  ]\n}",
+			},
+			want: "product/main.json:3:5: error: include[0]: common/missing.json doesnt exist",
+		},
+		{
+			name: "problems are reported in the included file",
+			files: map[string]string{
+				"common/base.yaml":  "packages:\n  - name: zlib\n    rpeo: madler/zlib\n",
+				"product/main.json": `{"include": ["../common/base.yaml"]}`,
+			},
+			want: `common/base.yaml:3:5: error: packages[0].rpeo: unknown field "rpeo", did you mean "repo"?`,
+		},
+	}
+
+	for _, test := range tests {
+		root := t.TempDir()
+		inDirectory(t, root)
+
+		for name, contents := range test.files {
+			if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(name, []byte(contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		settings, idx, problems, err := readManifest(filepath.Join("product", "main.json"))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		got := ""
+		if len(problems) != 0 {
+			// Circles are reported with absolute paths
+			got = strings.ReplaceAll(filepath.ToSlash(idx.errorOf(problems).Error()), filepath.ToSlash(root)+"/", "")
+		} else if test.check != nil {
+			got = test.check(settings)
+		}
+
+		if !strings.HasPrefix(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// localTag is the tag given to path sources, as they dont have one. It can still be matched by patch_sets
+const localTag = "local"
+
+// pullLocal points a package at its local directory. In copy mode the directory is copied into source/,
+// but only when something in it has changed since the last copy. Either way a package that has changed is marked
+// so that it gets configured again
+func pullLocal(pkg *Package, cached cachedSource) error {
+	path, err := filepath.Abs(pkg.Path)
+	if err != nil {
+		return err
+	}
+
+	if !directoryExists(path) {
+		return fmt.Errorf("Package [%s] path doesnt exist: %s", pkg.Name, path)
+	}
+
+	pkg.Tag = localTag
+	pkg.Commit = ""
+
+	pkg.Fingerprint, err = fingerprintDirectory(path)
+	if err != nil {
+		return err
+	}
+
+	// Built in place, so the fingerprint to compare with is the one taken after the last build (see recordBuiltPath)
+	if pkg.PathMode == referencePath {
+		pkg.Source = path
+		if pkg.Fingerprint == cached.Fingerprint {
+			fmt.Printf("[Found %s] %s\n", pkg.Name, pkg.Source)
+			return nil
+		}
+
+		pkg.Changed = true
+		fmt.Printf("[Changed %s] %s\n", pkg.Name, pkg.Source)
+		return nil
+	}
+
+	pkg.Source, err = filepath.Abs(filepath.Join("source", pkg.Name+"-"+localTag))
+	if err != nil {
+		return err
+	}
+
+	if pkg.Fingerprint == cached.Fingerprint && readStamp(pkg.Source) == pkg.stamp() {
+		fmt.Printf("[Found %s] %s\n", pkg.Name, pkg.Source)
+		return nil
+	}
+
+	pkg.Changed = true
+	fmt.Printf("[Changed %s] Copying %s...", pkg.Name, path)
+
+	err = os.RemoveAll(pkg.Source)
+	if err != nil {
+		return err
+	}
+
+	err = CreateIfNotExists(pkg.Source, 0700)
+	if err != nil {
+		return err
+	}
+
+	err = CopyDirectory(path, pkg.Source)
+	if err != nil {
+		return err
+	}
+
+	err = writeStamp(pkg.Source, pkg.stamp())
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Done!\n")
+
+	return nil
+}
+
+// recordBuiltPath fingerprints a reference path source again once it has been built in place, so that the files its
+// build wrote dont count as changes next run. Anything else is left alone
+func recordBuiltPath(pkg *Package) error {
+	if pkg.SourceType != pathSource || pkg.PathMode != referencePath {
+		return nil
+	}
+
+	cachedPackageSources, err := loadSourceCache()
+	if err != nil {
+		return err
+	}
+
+	entry, ok := cachedPackageSources[pkg.Name]
+	if !ok {
+		return nil
+	}
+
+	entry.Fingerprint, err = fingerprintDirectory(pkg.Source)
+	if err != nil {
+		return err
+	}
+	cachedPackageSources[pkg.Name] = entry
+
+	return writeSourceCache(cachedPackageSources)
+}
+
+// fingerprintDirectory hashes the name, size, mode and modification time of everything in a directory (other than .git)
+// which is enough to notice edits without reading every file
+func fingerprintDirectory(root string) (string, error) {
+	h := sha256.New()
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		relative, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(h, "%s %d %s %d\n", relative, info.Size(), info.Mode(), info.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPullLocal(t *testing.T) {
+	root := t.TempDir()
+	inDirectory(t, root)
+
+	local := filepath.Join(root, "local")
+	if err := os.MkdirAll(local, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(local, "main.c"), []byte("one"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pull := func(mode string, cached cachedSource) *Package {
+		t.Helper()
+
+		pkg := &Package{Name: "local", SourceType: pathSource, Path: local, PathMode: mode}
+		if err := pullLocal(pkg, cached); err != nil {
+			t.Fatal(err)
+		}
+		return pkg
+	}
+
+	touch := func(name, contents string) {
+		t.Helper()
+
+		// An hour on, as a file written twice in quick succession can keep the same modification time
+		later := time.Now().Add(time.Hour)
+		if err := ioutil.WriteFile(name, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.Mkdir("source", 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reference mode uses the directory as is, and notices edits to it
+	pkg := pull(referencePath, cachedSource{})
+	if pkg.Source != local || !pkg.Changed {
+		t.Errorf("The first pull of a reference should be a change in place, got %s %v", pkg.Source, pkg.Changed)
+	}
+
+	if err := writeSourceCache(map[string]cachedSource{pkg.Name: {Source: pkg.Source, Tag: localTag, Fingerprint: pkg.Fingerprint}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Building writes into the directory, which is fingerprinted again afterwards so it isnt a change next time
+	touch(filepath.Join(local, "main.o"), "built")
+	if err := recordBuiltPath(pkg); err != nil {
+		t.Fatal(err)
+	}
+	sources, err := loadSourceCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg = pull(referencePath, sources["local"]); pkg.Changed {
+		t.Errorf("Build outputs shouldnt count as a change")
+	}
+
+	touch(filepath.Join(local, "main.c"), "edited")
+	if pkg = pull(referencePath, sources["local"]); !pkg.Changed {
+		t.Errorf("Editing a file in a reference should be a change")
+	}
+	touch(filepath.Join(local, "main.c"), "one")
+	if err := os.Remove(filepath.Join(local, "main.o")); err != nil {
+		t.Fatal(err)
+	}
+
+	pkg = pull(copyPath, cachedSource{})
+	if !pkg.Changed {
+		t.Errorf("The first copy should be a change")
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(pkg.Source, "main.c")); err != nil || string(b) != "one" {
+		t.Errorf("Copy has %q %v", b, err)
+	}
+
+	cached := cachedSource{Source: pkg.Source, Fingerprint: pkg.Fingerprint}
+
+	// Build outputs in the copy dont matter, only the local directory is fingerprinted
+	if err := ioutil.WriteFile(filepath.Join(pkg.Source, "main.o"), []byte("built"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if pkg = pull(copyPath, cached); pkg.Changed {
+		t.Errorf("Nothing changed, so the copy shouldnt be refreshed")
+	}
+
+	touch(filepath.Join(local, "main.c"), "two")
+
+	pkg = pull(copyPath, cached)
+	if !pkg.Changed {
+		t.Errorf("Editing a file should refresh the copy")
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(pkg.Source, "main.c")); err != nil || string(b) != "two" {
+		t.Errorf("Refreshed copy has %q %v", b, err)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// lockedPackage records exactly what was downloaded for a package, so that builds are repeatable until the lock is updated
+type lockedPackage struct {
+	Tag    string `json:"tag"`
+	Commit string `json:"commit"`
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+
+	SignedBy string `json:"signed_by,omitempty"` // Key that signed it, for packages with a signature
+}
+
+// lockFile maps package names to what they are locked to, it sits next to the pkg file (example.json -> example.lock)
+type lockFile map[string]lockedPackage
+
+func lockFilePath(manifestPath string) string {
+	return strings.TrimSuffix(manifestPath, filepath.Ext(manifestPath)) + ".lock"
+}
+
+func loadLockFile(path string) (lockFile, error) {
+	lock := make(lockFile)
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return lock, nil
+		}
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, &lock)
+	if err != nil {
+		return nil, fmt.Errorf("Lock file %s is invalid: %s", path, err)
+	}
+
+	return lock, nil
+}
+
+func (l lockFile) write(path string) error {
+	b, err := json.MarshalIndent(l, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, append(b, '\n'), 0600)
+}
+
+// update re-resolves the selected packages (or all of them) and rewrites their lock file entries, leaving the rest alone
+func update(args []string) error {
+	flags := flag.NewFlagSet("update", flag.ExitOnError)
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		return fmt.Errorf("Usage: update <pkg file> [package...]")
+	}
+
+	settings, err := loadPackageManifest(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	lockPath := lockFilePath(flags.Arg(0))
+	lock, err := loadLockFile(lockPath)
+	if err != nil {
+		return err
+	}
+
+	selected, err := selectPackages(settings.Packages, flags.Args()[1:])
+	if err != nil {
+		return err
+	}
+
+	if !directoryExists("source") && os.Mkdir("source", 0700) != nil {
+		return fmt.Errorf("Unable to make source directory")
+	}
+
+	if !directoryExists("cache") && os.Mkdir("cache", 0700) != nil {
+		return fmt.Errorf("Unable to make cache directory")
+	}
+
+	sort.Slice(selected, func(i, j int) bool {
+		return selected[i].Name < selected[j].Name
+	})
+
+	for _, pkg := range selected {
+		if pkg.SourceType == pathSource {
+			fmt.Printf("%s: local source, nothing to update\n", pkg.Name)
+			continue
+		}
+
+		pkg.Tag, pkg.Commit, err = resolve(*pkg)
+		if err != nil {
+			return err
+		}
+
+		fetched, err := fetch(*pkg)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(lock.update(pkg.Name, fetched.lockedPackage))
+	}
+
+	return lock.write(lockPath)
+}
+
+// selectPackages finds the packages named, or returns all of them if no names are given
+func selectPackages(packages []*Package, names []string) ([]*Package, error) {
+	if len(names) == 0 {
+		return packages, nil
+	}
+
+	byName := make(map[string]*Package)
+	for _, pkg := range packages {
+		byName[pkg.Name] = pkg
+	}
+
+	selected := []*Package{}
+	for _, name := range names {
+		pkg, ok := byName[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("Package %s not found", name)
+		}
+		selected = append(selected, pkg)
+	}
+
+	return selected, nil
+}
+
+// update locks a package to what was just fetched, and describes what changed
+func (l lockFile) update(name string, fetched lockedPackage) string {
+	before, wasLocked := l[name]
+	l[name] = fetched
+
+	switch {
+	case !wasLocked:
+		return fmt.Sprintf("%s: (unlocked) -> %s (%s)", name, fetched.Tag, shortCommit(fetched.Commit))
+	case before.Commit == fetched.Commit && before.SHA256 == fetched.SHA256:
+		return fmt.Sprintf("%s: %s (%s) unchanged", name, before.Tag, shortCommit(before.Commit))
+	}
+
+	return fmt.Sprintf("%s: %s (%s) -> %s (%s)", name, before.Tag, shortCommit(before.Commit), fetched.Tag, shortCommit(fetched.Commit))
+}
+
+func shortCommit(commit string) string {
+	if len(commit) > 7 {
+		return commit[:7]
+	}
+	return commit
+}
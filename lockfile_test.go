@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLockFileRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+
+	if got := lockFilePath(filepath.Join(dir, "product.json")); got != filepath.Join(dir, "product.lock") {
+		t.Errorf("Lock file of product.json is %s", got)
+	}
+
+	path := filepath.Join(dir, "product.lock")
+
+	lock, err := loadLockFile(path)
+	if err != nil || len(lock) != 0 {
+		t.Fatalf("A missing lock file should be empty, got %v %v", lock, err)
+	}
+
+	lock["zlib"] = lockedPackage{
+		Tag:    "v1.3.1",
+		Commit: "51b7f2abdade71cd9bb0e7a373ef2610ec6f9daf",
+		URL:    "https://github.com/madler/zlib/archive/51b7f2abdade71cd9bb0e7a373ef2610ec6f9daf.tar.gz",
+		SHA256: "17e88863f3600672ab49182f217281b6fc4d3c762bde361935e436a95214d05c",
+	}
+	lock["openssl"] = lockedPackage{Tag: "openssl-3.0.13", Commit: "85cf92f55d9e2ac5aacf92bedd33fb890b9f8b4c"}
+
+	if err := lock.write(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadLockFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, lock) {
+		t.Errorf("Lock file read back as %v, want %v", loaded, lock)
+	}
+
+	// Sorted by package name, so the lock file diffs cleanly
+	b, _ := ioutil.ReadFile(path)
+	if strings.Index(string(b), `"openssl"`) > strings.Index(string(b), `"zlib"`) {
+		t.Errorf("Lock file isnt sorted:\n%s", b)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("{\"zlib\": "), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadLockFile(path); err == nil || !strings.Contains(err.Error(), "is invalid") {
+		t.Errorf("A broken lock file should fail, got %v", err)
+	}
+}
+
+func TestLockFileUpdate(t *testing.T) {
+	v1 := lockedPackage{Tag: "v1.3", Commit: "09155eaa2f9270dc4ed1fa13e2b4b2613e6e4851", SHA256: "aaaa"}
+	v2 := lockedPackage{Tag: "v1.3.1", Commit: "51b7f2abdade71cd9bb0e7a373ef2610ec6f9daf", SHA256: "bbbb"}
+	rebuilt := v1
+	rebuilt.SHA256 = "cccc" // Same commit, but github made a different archive of it
+
+	lock := lockFile{"openssl": {Tag: "openssl-3.0.13"}}
+
+	steps := []struct {
+		fetched lockedPackage
+		want    string
+	}{
+		{v1, "zlib: (unlocked) -> v1.3 (09155ea)"},
+		{v1, "zlib: v1.3 (09155ea) unchanged"},
+		{rebuilt, "zlib: v1.3 (09155ea) -> v1.3 (09155ea)"},
+		{v2, "zlib: v1.3 (09155ea) -> v1.3.1 (51b7f2a)"},
+	}
+
+	for _, step := range steps {
+		if got := lock.update("zlib", step.fetched); got != step.want {
+			t.Errorf("Updating to %s printed %q, want %q", step.fetched.Tag, got, step.want)
+		}
+		if lock["zlib"] != step.fetched {
+			t.Errorf("Updating to %s locked %v", step.fetched.Tag, lock["zlib"])
+		}
+	}
+
+	if lock["openssl"].Tag != "openssl-3.0.13" {
+		t.Errorf("Packages that werent updated should be left alone, openssl is %v", lock["openssl"])
+	}
+}
+
+func TestSelectPackages(t *testing.T) {
+	packages := []*Package{{Name: "zlib"}, {Name: "openssl"}, {Name: "curl"}}
+
+	all, err := selectPackages(packages, nil)
+	if err != nil || len(all) != 3 {
+		t.Errorf("No names should select everything, got %v %v", all, err)
+	}
+
+	some, err := selectPackages(packages, []string{"curl", " zlib"})
+	if err != nil || len(some) != 2 || some[0].Name != "curl" || some[1].Name != "zlib" {
+		t.Errorf("Selecting curl and zlib got %v %v", some, err)
+	}
+
+	if _, err := selectPackages(packages, []string{"libssh"}); err == nil || !strings.Contains(err.Error(), "libssh not found") {
+		t.Errorf("Selecting a package that doesnt exist should fail, got %v", err)
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"log"
 	"os"
 	"os/exec"
-	"path"
 	"path/filepath"
 	"runtime"
 	"strconv"
@@ -49,6 +48,16 @@ const (
 	QUIET
 )
 
+// Sub commands, if the first argument isnt one of these it is the pkg file
+var commands = map[string]func(args []string) error{
+	"outdated": outdated,
+	"update":   update,
+	"vendor":   vendor,
+	"validate": validate,
+	"schema":   schema,
+	"convert":  convert,
+}
+
 func main() {
 
 	flag.Bool("configure", false, "Just configure, no build")
@@ -56,9 +65,34 @@ func main() {
 	flag.Bool("image", false, "Just create image from build directory")
 	flag.Bool("clean", false, "Delete everything and start again")
 	flag.Bool("quiet", false, "Dont print build & configure output")
+	fresh := flag.Bool("fresh", false, "Extract every package again from its archive before building, discarding patched or built trees")
+	offline := flag.Bool("offline", false, "Dont use the network, fail if a package isnt already cached or vendored")
+	vendorDirectory := flag.String("vendor", "", "Use archives from a directory written by the vendor command")
+	jobs := flag.Int("jobs", 4, "How many packages to download at once")
+	flag.StringVar(&auth.tokenFile, "token-file", "", "File holding the github token, or lines of \"<host> <token>\"")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] <pkg file> [package]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s outdated [-json] <pkg file>\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s update <pkg file> [package...]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s vendor <pkg file> <directory>\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s validate <pkg file>\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s schema [-o file] [-check file]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s convert [-to json|yaml|toml] <pkg file> [output file]\n\nOptions:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 
 	flag.Parse()
 
+	if len(flag.Args()) > 0 {
+		if command, ok := commands[flag.Args()[0]]; ok {
+			err := command(flag.Args()[1:])
+			reportRateLimit()
+			check(err)
+			return
+		}
+	}
+
 	var buildOptions Bits
 	flag.Visit(func(f *flag.Flag) {
 		switch f.Name {
@@ -114,7 +148,15 @@ func main() {
 			settings.Packages = []*Package{singleBuild}
 		}
 
-		err := pullPackages(settings.OauthToken, settings.Packages)
+		err := pullPackages(settings.Packages, pullOptions{
+			LockFile:       lockFilePath(flag.Args()[0]),
+			Fresh:          *fresh,
+			KeepOldSources: settings.KeepOldSources,
+			Offline:        *offline,
+			Vendor:         *vendorDirectory,
+			Jobs:           *jobs,
+		})
+		reportRateLimit()
 		check(err)
 
 		err = configureAndBuild(settings.Packages, buildOptions)
@@ -286,6 +328,13 @@ func createImage(settings pkgManifest) error {
 		return fmt.Errorf("Unable to copy pkg file: %s", err)
 	}
 
+	if Exists(lockFilePath(flag.Args()[0])) {
+		_, err = copyFile(lockFilePath(flag.Args()[0]), "image/")
+		if err != nil {
+			return fmt.Errorf("Unable to copy lock file: %s", err)
+		}
+	}
+
 	log.Println("Done!")
 
 	if settings.ImageSettings.Filename == "" {
@@ -348,11 +397,12 @@ func configureAndBuild(packages []*Package, buildOptions Bits) error {
 
 		fmt.Printf("\n%s\n", order[i].Name)
 		fmt.Printf("Configuration:  %s\n", order[i].ConfigurationOptions)
+		fmt.Printf("Tag:           '%s'\n", order[i].Tag)
 		fmt.Printf("Patches:       '%s'\n", order[i].Patches)
 		fmt.Printf("Install:       '%s'\n", order[i].Install)
 		fmt.Printf("Directory:     '%s'\n\n", order[i].Source)
 
-		if buildOptions.Has(CONFIGURE) {
+		if buildOptions.Has(CONFIGURE) || order[i].Changed {
 			actions := order[i].ConfigurationOptions + " && make clean"
 
 			cmd := exec.Command("bash", "-c", "cd "+order[i].Source+"; "+actions)
@@ -368,39 +418,9 @@ func configureAndBuild(packages []*Package, buildOptions Bits) error {
 			}
 		}
 
-		if len(order[i].Patches) != 0 {
-			fmt.Printf("Package [%s] has patches, applying them:\n", order[i].Name)
-
-			if !directoryExists(order[i].Patches) {
-				return fmt.Errorf("Patches directory doesnt exist: %s", order[i].Patches)
-			}
-
-			dirList, err := os.ReadDir(order[i].Patches)
-			if err != nil {
-				return err
-			}
-			for _, file := range dirList {
-				if file.Type().IsRegular() && filepath.Ext(file.Name()) == ".patch" {
-					patchPath, err := filepath.Abs(path.Join(order[i].Patches, file.Name()))
-					if err != nil {
-						return err
-					}
-
-					fmt.Printf("Applying [%s]...", patchPath)
-					cmd := exec.Command("patch", "-f", "-p0", "-d", order[i].Source, "-i", patchPath)
-					cmd.Stdout = os.Stdout
-					cmd.Stderr = os.Stderr
-
-					err = cmd.Run()
-					if err != nil {
-						fmt.Printf("Failed!\n")
-						continue
-					}
-					fmt.Printf("Done!\n")
-
-				}
-			}
-
+		err := applyPatches(order[i])
+		if err != nil {
+			return err
 		}
 
 		if buildOptions.Has(BUILD) {
@@ -425,6 +445,10 @@ func configureAndBuild(packages []*Package, buildOptions Bits) error {
 			}
 		}
 
+		err = recordBuiltPath(order[i])
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
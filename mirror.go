@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var mirrorPlaceholder = regexp.MustCompile(`{[a-z0-9]*}`)
+
+// mirrorVariables are what can be used in a mirror url template
+func mirrorVariables(p Package, upstream string) map[string]string {
+	variables := map[string]string{
+		"name":   p.Name,
+		"tag":    p.Tag,
+		"commit": p.Commit,
+		"sha256": p.ArchiveSHA256,
+		"file":   path.Base(upstream),
+	}
+
+	if owner, name, err := githubRepository(p.Repository); err == nil {
+		variables["owner"], variables["repo"] = owner, name
+	}
+
+	return variables
+}
+
+// checkMirror makes sure a mirror url only uses placeholders we know about
+func checkMirror(mirror string) error {
+	if _, err := url.Parse(mirror); err != nil {
+		return err
+	}
+
+	known := mirrorVariables(Package{}, "")
+	known["owner"], known["repo"] = "", ""
+
+	for _, placeholder := range mirrorPlaceholder.FindAllString(mirror, -1) {
+		if _, ok := known[strings.Trim(placeholder, "{}")]; !ok {
+			return fmt.Errorf("Mirror '%s' has an unknown placeholder %s", mirror, placeholder)
+		}
+	}
+
+	return nil
+}
+
+// mirrorURL works out where a mirror would have the upstream url. A mirror with placeholders ({owner}, {repo}, {name}, {tag},
+// {commit}, {sha256}, {file}) has them filled in, otherwise it replaces the scheme and host of the upstream url
+// Returns false if the mirror needs something we dont know yet, like the sha256 of a package that isnt locked
+func mirrorURL(mirror, upstream string, variables map[string]string) (string, bool) {
+	if !mirrorPlaceholder.MatchString(mirror) {
+		u, err := url.Parse(upstream)
+		if err != nil {
+			return "", false
+		}
+
+		return strings.TrimSuffix(mirror, "/") + u.EscapedPath(), true
+	}
+
+	return expandPlaceholders(mirror, variables)
+}
+
+// expandPlaceholders fills in the placeholders of a template, returning false if any of them are empty
+func expandPlaceholders(template string, variables map[string]string) (string, bool) {
+	complete := true
+	expanded := mirrorPlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		value := variables[strings.Trim(placeholder, "{}")]
+		complete = complete && len(value) != 0
+		return value
+	})
+
+	return expanded, complete
+}
+
+// downloadArchive fetches the archive at the upstream url into outputFile, trying the packages mirror directory and mirror urls
+// before upstream. Every candidate is checked against the locked sha256 and the one published upstream (either can be empty),
+// and the first that matches is used. Mirrors are only tried when there is a sha256 to check them against, otherwise
+// whatever a mirror handed us would end up in the lock file unchecked
+func downloadArchive(p Package, outputFile, upstream, published string) (digest string, err error) {
+	published = strings.ToLower(published)
+
+	check := func(digest string) error {
+		if len(p.ArchiveSHA256) != 0 && digest != p.ArchiveSHA256 {
+			return fmt.Errorf("has sha256 %s but the lock file has %s", digest, p.ArchiveSHA256)
+		}
+		if len(published) != 0 && digest != published {
+			return fmt.Errorf("failed verification, published sha256 %s but downloaded %s", published, digest)
+		}
+		return nil
+	}
+
+	known := p.ArchiveSHA256
+	if len(known) == 0 {
+		known = published
+	}
+
+	urls := []string{}
+	if len(known) != 0 {
+		if len(p.MirrorDirectory) != 0 {
+			candidates := []string{vendoredArchive(p.MirrorDirectory, known), filepath.Join(p.MirrorDirectory, path.Base(upstream))}
+			if archive, ok := findArchive(known, candidates...); ok && check(known) == nil {
+				return known, Copy(archive, outputFile)
+			}
+		}
+
+		variables := mirrorVariables(p, upstream)
+		variables["sha256"] = known
+
+		for _, mirror := range p.Mirrors {
+			if u, ok := mirrorURL(mirror, upstream, variables); ok {
+				urls = append(urls, u)
+			}
+		}
+	}
+	urls = append(urls, upstream)
+
+	failures := []string{}
+	for _, u := range urls {
+		digest, err = downloadFile(outputFile, u, p.Progress)
+		if err == nil {
+			if err = check(digest); err != nil {
+				// Forgotten so that next time it is downloaded again, rather than the cache saying it hasnt changed
+				forgetDownload(outputFile, u, digest)
+				err = fmt.Errorf("%s %s", u, err)
+			}
+		}
+
+		if err == nil {
+			return digest, nil
+		}
+
+		failures = append(failures, err.Error())
+	}
+
+	os.Remove(outputFile)
+	return "", fmt.Errorf("Unable to download %s from anywhere:\n\t%s", path.Base(upstream), strings.Join(failures, "\n\t"))
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMirrorURL(t *testing.T) {
+	upstream := "https://github.com/madler/zlib/archive/0123abc.tar.gz"
+	p := Package{Name: "zlib", Repository: "https://github.com/madler/zlib", Tag: "v1.3", Commit: "0123abc"}
+	variables := mirrorVariables(p, upstream)
+
+	tests := []struct {
+		mirror   string
+		sha256   string
+		want     string
+		complete bool
+	}{
+		{"https://mirror.internal/github", "", "https://mirror.internal/github/madler/zlib/archive/0123abc.tar.gz", true},
+		{"https://mirror.internal/github/", "", "https://mirror.internal/github/madler/zlib/archive/0123abc.tar.gz", true},
+		{"https://cache.internal/{owner}/{repo}/{tag}/{file}", "", "https://cache.internal/madler/zlib/v1.3/0123abc.tar.gz", true},
+		{"https://cache.internal/{name}/{commit}", "", "https://cache.internal/zlib/0123abc", true},
+		{"https://cache.internal/{name}/{sha256}", "", "https://cache.internal/zlib/", false},
+		{"https://cache.internal/{name}/{sha256}", "feed", "https://cache.internal/zlib/feed", true},
+	}
+
+	for _, test := range tests {
+		variables["sha256"] = test.sha256
+		got, complete := mirrorURL(test.mirror, upstream, variables)
+		if got != test.want || complete != test.complete {
+			t.Errorf("mirrorURL(%s) = %s, %v, want %s, %v", test.mirror, got, complete, test.want, test.complete)
+		}
+	}
+
+	if err := checkMirror("https://cache.internal/{name}/{version}"); err == nil {
+		t.Errorf("A mirror with an unknown placeholder should be refused")
+	}
+	if err := checkMirror("https://cache.internal/{owner}/{repo}/{sha256}"); err != nil {
+		t.Errorf("Known placeholders should be fine: %s", err)
+	}
+}
+
+func TestDownloadArchive(t *testing.T) {
+	inDirectory(t, t.TempDir())
+	quickNetwork(t)
+	network.retries = 0 // So each mirror is only asked once
+	for _, dir := range []string{"source", "cache"} {
+		if err := os.Mkdir(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	good, bad := "the archive", "something else"
+
+	var mu sync.Mutex
+	requested := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, r.URL.Path)
+		mu.Unlock()
+
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/down/"):
+			http.Error(w, "down", http.StatusInternalServerError)
+		case strings.HasPrefix(r.URL.Path, "/bad/"):
+			w.Write([]byte(bad))
+		default:
+			w.Write([]byte(good))
+		}
+	}))
+	defer server.Close()
+
+	upstream := server.URL + "/owner/tool/archive/0123abc.tar.gz"
+	outputFile := filepath.Join("source", "tool.tar.gz")
+
+	mirrors := []string{server.URL + "/down", server.URL + "/bad", server.URL + "/good/{name}/{sha256}", server.URL + "/good"}
+
+	tests := []struct {
+		name      string
+		sha256    string
+		published string
+		mirrors   []string
+		requested []string
+		err       string
+	}{
+		{
+			name:      "locked, tried in order until one matches",
+			sha256:    sha256Hex(good),
+			mirrors:   mirrors,
+			requested: []string{"/down/owner/tool/archive/0123abc.tar.gz", "/bad/owner/tool/archive/0123abc.tar.gz", "/good/tool/" + sha256Hex(good)},
+		},
+		{
+			name:      "unlocked, straight to upstream as there is nothing to check a mirror against",
+			mirrors:   mirrors,
+			requested: []string{"/owner/tool/archive/0123abc.tar.gz"},
+		},
+		{
+			name:      "published checksum, mirrors can be checked against it",
+			published: strings.ToUpper(sha256Hex(good)),
+			mirrors:   mirrors[1:],
+			requested: []string{"/bad/owner/tool/archive/0123abc.tar.gz", "/good/tool/" + sha256Hex(good)},
+		},
+		{
+			name:      "every mirror fails, upstream is the fallback",
+			sha256:    sha256Hex(good),
+			mirrors:   mirrors[:2],
+			requested: []string{"/down/owner/tool/archive/0123abc.tar.gz", "/bad/owner/tool/archive/0123abc.tar.gz", "/owner/tool/archive/0123abc.tar.gz"},
+		},
+		{
+			name:      "nothing matches the lock",
+			sha256:    sha256Hex("what was locked"),
+			mirrors:   mirrors[1:2],
+			requested: []string{"/bad/owner/tool/archive/0123abc.tar.gz", "/owner/tool/archive/0123abc.tar.gz"},
+			err:       "the lock file has",
+		},
+	}
+
+	for _, test := range tests {
+		os.RemoveAll("cache")
+		requested = nil
+
+		p := Package{Name: "tool", Repository: "https://github.com/owner/tool", Commit: "0123abc", ArchiveSHA256: test.sha256, Mirrors: test.mirrors}
+		digest, err := downloadArchive(p, outputFile, upstream, test.published)
+
+		switch {
+		case len(test.err) != 0:
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: should fail with %q, got %v", test.name, test.err, err)
+			}
+			if Exists(outputFile) {
+				t.Errorf("%s: failed download was left behind", test.name)
+			}
+		case err != nil:
+			t.Errorf("%s: %s", test.name, err)
+		case digest != sha256Hex(good):
+			t.Errorf("%s: downloaded sha256 %s", test.name, digest)
+		}
+
+		if strings.Join(requested, " ") != strings.Join(test.requested, " ") {
+			t.Errorf("%s: requested %v, want %v", test.name, requested, test.requested)
+		}
+	}
+
+	// A mirror that handed over the wrong archive isnt remembered, so it is asked again next time
+	if Exists(httpCachePath(server.URL + "/bad/owner/tool/archive/0123abc.tar.gz")) {
+		t.Errorf("Cache entry for a mismatched download was kept")
+	}
+
+	// A locked archive in the mirror directory is used without asking anyone
+	directory := t.TempDir()
+	if err := os.Mkdir(filepath.Join(directory, "objects"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(vendoredArchive(directory, sha256Hex(good)), []byte(good), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	requested = nil
+	p := Package{Name: "tool", ArchiveSHA256: sha256Hex(good), Mirrors: mirrors, MirrorDirectory: directory}
+	if digest, err := downloadArchive(p, outputFile, upstream, ""); err != nil || digest != sha256Hex(good) || len(requested) != 0 {
+		t.Errorf("Mirror directory gave %s %v, requested %v", digest, err, requested)
+	}
+	if b, err := ioutil.ReadFile(outputFile); err != nil || string(b) != good {
+		t.Errorf("Archive copied from the mirror directory is %q %v", b, err)
+	}
+}
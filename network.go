@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// networkSettings is the "network" block of the pkg file, durations are strings like "30s" or "2m"
+type networkSettings struct {
+	Timeout    string `json:"timeout"`     // Connecting and waiting for a response, and each attempt at an api request
+	Retries    *int   `json:"retries"`     // How many times a failed request is tried again
+	Backoff    string `json:"backoff"`     // Wait before the first retry, doubled for every one after
+	MaxBackoff string `json:"max_backoff"` // Longest wait between retries
+	MaxWait    string `json:"max_wait"`    // Longest we will wait for a rate limit to reset before giving up
+}
+
+type networkConfig struct {
+	timeout    time.Duration
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	maxWait    time.Duration
+}
+
+var network = networkConfig{
+	timeout:    30 * time.Second,
+	retries:    4,
+	backoff:    time.Second,
+	maxBackoff: 30 * time.Second,
+	maxWait:    5 * time.Minute,
+}
+
+// configure replaces the defaults with whatever is set in the pkg file
+func (s networkSettings) configure() error {
+	durations := []struct {
+		name  string
+		value string
+		field *time.Duration
+	}{
+		{"timeout", s.Timeout, &network.timeout},
+		{"backoff", s.Backoff, &network.backoff},
+		{"max_backoff", s.MaxBackoff, &network.maxBackoff},
+		{"max_wait", s.MaxWait, &network.maxWait},
+	}
+
+	for _, d := range durations {
+		if len(d.value) == 0 {
+			continue
+		}
+
+		parsed, err := time.ParseDuration(d.value)
+		if err != nil || parsed < 0 {
+			return fmt.Errorf("network %s '%s' isnt a valid duration, use something like \"30s\"", d.name, d.value)
+		}
+		*d.field = parsed
+	}
+
+	if s.Retries != nil {
+		if *s.Retries < 0 {
+			return fmt.Errorf("network retries cant be negative")
+		}
+		network.retries = *s.Retries
+	}
+
+	return nil
+}
+
+// newClient gives up on servers that dont respond. attemptTimeout (if set) limits each attempt at a request rather than
+// the whole thing, which can include waiting for a rate limit to reset
+func newClient(attemptTimeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: network.timeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = network.timeout
+	transport.ResponseHeaderTimeout = network.timeout
+
+	return &http.Client{Transport: retryTransport{base: authTransport{base: transport}, attemptTimeout: attemptTimeout}}
+}
+
+// downloadClient has no overall timeout, as large archives can take a while
+func downloadClient() *http.Client {
+	return newClient(0)
+}
+
+// apiClient is for api requests, which are small so each attempt gets the network timeout
+func apiClient() *http.Client {
+	return newClient(network.timeout)
+}
+
+// retryTransport retries requests that failed for reasons that might go away: connection problems, server errors and rate limits
+type retryTransport struct {
+	base           http.RoundTripper
+	attemptTimeout time.Duration
+}
+
+func (t retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := req.Context(), context.CancelFunc(func() {})
+		if t.attemptTimeout > 0 {
+			ctx, cancel = context.WithTimeout(req.Context(), t.attemptTimeout)
+		}
+
+		attemptReq := req.WithContext(ctx)
+		if attempt > 0 && req.Body != nil {
+			if req.GetBody == nil {
+				cancel()
+				return nil, fmt.Errorf("Cant retry %s %s, its body cant be read again", req.Method, req.URL)
+			}
+
+			body, err := req.GetBody()
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			attemptReq = req.Clone(ctx)
+			attemptReq.Body = body
+		}
+
+		resp, err := t.base.RoundTrip(attemptReq)
+		if err == nil {
+			recordRateLimit(resp)
+			resp.Body = cancelOnClose{resp.Body, cancel} // The attempt lasts until its body has been read
+		} else {
+			cancel()
+		}
+
+		wait, retry, reason := shouldRetry(resp, err, attempt)
+		if !retry || attempt >= network.retries || req.Context().Err() != nil {
+			return resp, err
+		}
+
+		if wait > network.maxWait {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return nil, githubError(fmt.Errorf("%s, which is longer than the network max_wait of %s", reason, network.maxWait))
+		}
+
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+		}
+
+		warnf("[Retry] %s %s: %s, trying again in %s (%d/%d)\n", req.Method, req.URL, reason, wait.Round(100*time.Millisecond), attempt+1, network.retries)
+
+		if err := sleep(req.Context(), wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// cancelOnClose releases the context of an attempt once its response body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// sleep waits for d, or until ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shouldRetry decides whether a request is worth trying again, and how long to wait first
+func shouldRetry(resp *http.Response, err error, attempt int) (wait time.Duration, retry bool, reason string) {
+	if err != nil {
+		return backoff(attempt), true, err.Error()
+	}
+
+	if limited, until := rateLimited(resp); limited {
+		return until, true, fmt.Sprintf("%s, rate limited until %s", resp.Status, time.Now().Add(until).Format("15:04:05"))
+	}
+
+	switch resp.StatusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return backoff(attempt), true, resp.Status
+	}
+
+	return 0, false, ""
+}
+
+// rateLimited checks for githubs rate limit responses, and how long they say to wait
+func rateLimited(resp *http.Response) (bool, time.Duration) {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return false, 0
+	}
+
+	// Secondary rate limits say how long to wait directly
+	if retryAfter := resp.Header.Get("Retry-After"); len(retryAfter) != 0 {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil {
+			return true, time.Duration(seconds) * time.Second
+		}
+		if at, err := http.ParseTime(retryAfter); err == nil {
+			return true, time.Until(at)
+		}
+	}
+
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			// A second extra, as the reset time is rounded down
+			return true, time.Until(time.Unix(reset, 0)) + time.Second
+		}
+	}
+
+	// Some other reason for a 403, like a bad token, which waiting wont fix
+	if resp.StatusCode == http.StatusForbidden {
+		return false, 0
+	}
+
+	return true, backoff(0)
+}
+
+// backoff doubles the wait for every attempt, with some jitter so that parallel requests dont all retry at once
+func backoff(attempt int) time.Duration {
+	wait := network.backoff << uint(attempt)
+	if wait > network.maxBackoff || wait <= 0 {
+		wait = network.maxBackoff
+	}
+
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+type rateLimitBudget struct {
+	limit, remaining int
+	reset            time.Time
+}
+
+// githubRateLimits is the most recent rate limit budget github told us about, for each resource (graphql, core...)
+var githubRateLimits = struct {
+	sync.Mutex
+	budgets map[string]rateLimitBudget
+}{budgets: make(map[string]rateLimitBudget)}
+
+func recordRateLimit(resp *http.Response) {
+	limit, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Limit"))
+	if err != nil {
+		return
+	}
+
+	remaining, _ := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining"))
+	reset, _ := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+
+	resource := resp.Header.Get("X-RateLimit-Resource")
+	if len(resource) == 0 {
+		resource = "api"
+	}
+
+	githubRateLimits.Lock()
+	defer githubRateLimits.Unlock()
+
+	githubRateLimits.budgets[resource] = rateLimitBudget{limit: limit, remaining: remaining, reset: time.Unix(reset, 0)}
+}
+
+// rateLimitSummary describes the remaining github api budget, or is empty if we havent used the api
+func rateLimitSummary() string {
+	githubRateLimits.Lock()
+	defer githubRateLimits.Unlock()
+
+	resources := []string{}
+	for resource := range githubRateLimits.budgets {
+		resources = append(resources, resource)
+	}
+	sort.Strings(resources)
+
+	summaries := []string{}
+	for _, resource := range resources {
+		b := githubRateLimits.budgets[resource]
+		summaries = append(summaries, fmt.Sprintf("%s %d of %d remaining, resets at %s", resource, b.remaining, b.limit, b.reset.Format("15:04:05")))
+	}
+
+	if len(summaries) == 0 {
+		return ""
+	}
+
+	return "Github rate limit: " + strings.Join(summaries, ", ")
+}
+
+// reportRateLimit prints the remaining github api budget, to stderr so it stays out of the way of anything machine readable
+func reportRateLimit() {
+	if summary := rateLimitSummary(); len(summary) != 0 {
+		fmt.Fprintln(os.Stderr, summary)
+	}
+}
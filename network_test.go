@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// quickNetwork makes retries fast for the length of a test
+func quickNetwork(t *testing.T) {
+	previous := network
+	t.Cleanup(func() { network = previous })
+
+	network = networkConfig{
+		timeout:    time.Second,
+		retries:    3,
+		backoff:    time.Millisecond,
+		maxBackoff: 5 * time.Millisecond,
+		maxWait:    10 * time.Second,
+	}
+}
+
+// failingServer answers the first len(failures) requests with failures[i], then with a 200
+func failingServer(t *testing.T, failures ...func(w http.ResponseWriter, r *http.Request)) (*httptest.Server, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(&requests, 1)) - 1
+		if n < len(failures) {
+			failures[n](w, r)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &requests
+}
+
+func status(code int, headers ...string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i+1 < len(headers); i += 2 {
+			w.Header().Set(headers[i], headers[i+1])
+		}
+		w.WriteHeader(code)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	quickNetwork(t)
+
+	reset := func() string { return strconv.FormatInt(time.Now().Add(2*time.Second).Unix(), 10) }
+
+	tests := []struct {
+		name     string
+		failures []func(w http.ResponseWriter, r *http.Request)
+		requests int32
+		status   int
+		minWait  time.Duration
+	}{
+		{"server errors", []func(w http.ResponseWriter, r *http.Request){status(http.StatusServiceUnavailable), status(http.StatusBadGateway)}, 3, http.StatusOK, 0},
+		{"too many server errors", []func(w http.ResponseWriter, r *http.Request){
+			status(http.StatusInternalServerError), status(http.StatusInternalServerError), status(http.StatusInternalServerError), status(http.StatusInternalServerError),
+		}, 4, http.StatusInternalServerError, 0},
+		{"not found isnt retried", []func(w http.ResponseWriter, r *http.Request){status(http.StatusNotFound)}, 1, http.StatusNotFound, 0},
+		{"bad token isnt retried", []func(w http.ResponseWriter, r *http.Request){status(http.StatusForbidden)}, 1, http.StatusForbidden, 0},
+		// Both waits are longer than the timeout, which only covers a single attempt
+		{"retry after", []func(w http.ResponseWriter, r *http.Request){status(http.StatusTooManyRequests, "Retry-After", "1")}, 2, http.StatusOK, time.Second},
+		{"rate limit reset", []func(w http.ResponseWriter, r *http.Request){status(http.StatusForbidden, "X-RateLimit-Remaining", "0", "X-RateLimit-Reset", reset())}, 2, http.StatusOK, time.Second},
+	}
+
+	for _, test := range tests {
+		network.timeout = 500 * time.Millisecond
+		server, requests := failingServer(t, test.failures...)
+
+		start := time.Now()
+		resp, err := apiClient().Get(server.URL)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != test.status || *requests != test.requests {
+			t.Errorf("%s: got %s after %d requests, want %d after %d", test.name, resp.Status, *requests, test.status, test.requests)
+		}
+		if waited := time.Since(start); waited < test.minWait {
+			t.Errorf("%s: only waited %s, want at least %s", test.name, waited, test.minWait)
+		}
+	}
+}
+
+func TestRetryMaxWait(t *testing.T) {
+	quickNetwork(t)
+	network.maxWait = time.Minute
+
+	later := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	server, requests := failingServer(t, status(http.StatusForbidden, "X-RateLimit-Remaining", "0", "X-RateLimit-Reset", later))
+
+	start := time.Now()
+	_, err := apiClient().Get(server.URL)
+	if err == nil || !strings.Contains(err.Error(), "max_wait") {
+		t.Errorf("A rate limit resetting after max_wait should fail, got %v", err)
+	}
+	if *requests != 1 || time.Since(start) > 5*time.Second {
+		t.Errorf("Should give up straight away, made %d requests in %s", *requests, time.Since(start))
+	}
+
+	server, _ = failingServer(t, status(http.StatusTooManyRequests, "Retry-After", "120"))
+	if _, err := apiClient().Get(server.URL); err == nil || !strings.Contains(err.Error(), "max_wait") {
+		t.Errorf("A Retry-After longer than max_wait should fail, got %v", err)
+	}
+}
+
+func TestRetryAttemptTimeout(t *testing.T) {
+	quickNetwork(t)
+	network.timeout = 200 * time.Millisecond
+
+	// The first attempt hangs, the one after it answers
+	hang := func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}
+	server, requests := failingServer(t, hang)
+
+	resp, err := apiClient().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || *requests != 2 {
+		t.Errorf("Got %s after %d requests, the hung attempt should have timed out and been retried", resp.Status, *requests)
+	}
+}
+
+func TestRetryWaitIsCancelled(t *testing.T) {
+	quickNetwork(t)
+	network.backoff, network.maxBackoff = time.Minute, time.Minute
+	network.maxWait = time.Hour
+
+	server, _ := failingServer(t, status(http.StatusServiceUnavailable))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err = apiClient().Do(request)
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > 5*time.Second {
+		t.Errorf("Waiting to retry should stop when the request is cancelled, got %v after %s", err, time.Since(start))
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+)
+
+type outdatedPackage struct {
+	Name    string `json:"name"`
+	Current string `json:"current"` // What is locked, or cached in source/ if there is no lock
+	Wanted  string `json:"wanted"`  // Newest tag that satisfies the packages version and tag_regex
+	Latest  string `json:"latest"`  // Newest tag in the repository
+	Error   string `json:"error,omitempty"`
+}
+
+// outdated compares what is currently cached against what upstream has available
+func outdated(args []string) error {
+	flags := flag.NewFlagSet("outdated", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "Print results as JSON rather than a table")
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		return fmt.Errorf("Usage: outdated [-json] <pkg file>")
+	}
+
+	settings, err := loadPackageManifest(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	cachedPackageSources, err := loadSourceCache()
+	if err != nil {
+		return err
+	}
+
+	lock, err := loadLockFile(lockFilePath(flags.Arg(0)))
+	if err != nil {
+		return err
+	}
+
+	results := []outdatedPackage{}
+	for _, pkg := range settings.Packages {
+		result := outdatedPackage{
+			Name:    pkg.Name,
+			Current: cachedPackageSources[pkg.Name].Tag,
+		}
+
+		if locked, ok := lock[pkg.Name]; ok {
+			result.Current = locked.Tag
+		}
+
+		if pkg.SourceType == pathSource {
+			result.Current, result.Wanted, result.Latest = localTag, localTag, localTag
+			results = append(results, result)
+			continue
+		}
+
+		result.Wanted, result.Latest, err = newestTags(pkg)
+		if err != nil {
+			result.Error = err.Error()
+		}
+
+		results = append(results, result)
+	}
+
+	return printOutdated(os.Stdout, results, *asJSON)
+}
+
+// printOutdated writes the results as a table, or as JSON for scripts
+func printOutdated(out io.Writer, results []outdatedPackage, asJSON bool) error {
+	if asJSON {
+		b, err := json.MarshalIndent(results, "", "\t")
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintln(out, string(b))
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PACKAGE\tCURRENT\tWANTED\tLATEST\t")
+	for _, result := range results {
+		if len(result.Error) != 0 {
+			fmt.Fprintf(w, "%s\t%s\terror: %s\t\t\n", result.Name, orDash(result.Current), result.Error)
+			continue
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t\n", result.Name, orDash(result.Current), result.Wanted, result.Latest)
+	}
+
+	return w.Flush()
+}
+
+// newestTags finds the newest tag the package would accept, and the newest tag overall
+func newestTags(pkg *Package) (wanted, latest string, err error) {
+	source, err := newTagSource(*pkg)
+	if err != nil {
+		return "", "", err
+	}
+
+	tags, err := source.Tags()
+	if err != nil {
+		return "", "", err
+	}
+
+	return compareTags(tags, pkg)
+}
+
+// compareTags picks the newest of the tags the package would accept, and the newest overall
+func compareTags(tags []remoteTag, pkg *Package) (wanted, latest string, err error) {
+	newest, err := selectTag(tags, nil, "")
+	if err != nil {
+		return "", "", err
+	}
+	latest = newest.Name
+
+	switch {
+	case len(pkg.Version) != 0 && !isVersionConstraint(pkg.Version):
+		// Pinned to an exact tag, branch or commit so there is nothing newer that it would accept
+		return pkg.Version, latest, nil
+
+	case len(pkg.Version) != 0:
+		constraint, err := parseVersionConstraint(pkg.Version)
+		if err != nil {
+			return "", latest, err
+		}
+
+		newest, err = selectTag(tags, &constraint, pkg.ValidTagRegex)
+		if err != nil {
+			return "", latest, err
+		}
+
+	default:
+		newest, err = selectTag(tags, nil, pkg.ValidTagRegex)
+		if err != nil {
+			return "", latest, err
+		}
+	}
+
+	return newest.Name, latest, nil
+}
+
+func orDash(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return s
+}
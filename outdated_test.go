@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestCompareTags(t *testing.T) {
+	tags := []remoteTag{}
+	for _, name := range []string{"v1.2.11", "v1.2.13", "v1.3.1", "v2.0.0", "v2.1.0-rc1", "nightly"} {
+		tags = append(tags, newRemoteTag(name, "commit-"+name))
+	}
+
+	tests := []struct {
+		pkg    Package
+		wanted string
+		err    string
+	}{
+		{Package{}, "v2.0.0", ""},
+		{Package{ValidTagRegex: `^v1\.`}, "v1.3.1", ""},
+		{Package{Version: ">=1.2.11 <1.3"}, "v1.2.13", ""},
+		{Package{Version: ">=1.2 <2", ValidTagRegex: `^v1\.2\.`}, "v1.2.13", ""},
+		{Package{Version: "v1.2.11"}, "v1.2.11", ""}, // Pinned, so that is all it would accept
+		{Package{Version: "main"}, "main", ""},
+		{Package{Version: ">=3"}, "", "No tags match version '>=3'"},
+	}
+
+	for _, test := range tests {
+		wanted, latest, err := compareTags(tags, &test.pkg)
+		switch {
+		case len(test.err) != 0 && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%+v should fail with %q, got %v", test.pkg, test.err, err)
+		case len(test.err) == 0 && err != nil:
+			t.Errorf("%+v: %s", test.pkg, err)
+		case wanted != test.wanted:
+			t.Errorf("%+v wanted %s, want %s", test.pkg, wanted, test.wanted)
+		}
+
+		if latest != "v2.0.0" {
+			t.Errorf("%+v latest is %s, want v2.0.0", test.pkg, latest)
+		}
+	}
+}
+
+func TestPrintOutdated(t *testing.T) {
+	results := []outdatedPackage{
+		{Name: "zlib", Current: "v1.2.11", Wanted: "v1.2.13", Latest: "v1.3.1"},
+		{Name: "openssl", Wanted: "openssl-3.0.13", Latest: "openssl-3.2.1"},
+		{Name: "curl", Current: "curl-8_5_0", Error: "No tags match regex '^curl-9'"},
+	}
+
+	table := bytes.Buffer{}
+	if err := printOutdated(&table, results, false); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "PACKAGE  CURRENT     WANTED                                LATEST\n" +
+		"zlib     v1.2.11     v1.2.13                               v1.3.1\n" +
+		"openssl  -           openssl-3.0.13                        openssl-3.2.1\n" +
+		"curl     curl-8_5_0  error: No tags match regex '^curl-9'\n"
+
+	// Every column is padded, the last one included
+	lines := strings.Split(table.String(), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimRight(lines[i], " ")
+	}
+	if got := strings.Join(lines, "\n"); got != want {
+		t.Errorf("Table is:\n%s\nwant:\n%s", got, want)
+	}
+
+	asJSON := bytes.Buffer{}
+	if err := printOutdated(&asJSON, results, true); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded []outdatedPackage
+	if err := json.Unmarshal(asJSON.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(results) || decoded[0] != results[0] || decoded[2] != results[2] {
+		t.Errorf("JSON round trip gave %+v, want %+v", decoded, results)
+	}
+	if strings.Contains(asJSON.String(), `"error": ""`) {
+		t.Errorf("Packages without an error shouldnt have an error field:\n%s", asJSON.String())
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+// selectPatches works out which patch files apply to the tag a package resolved to.
+// Patches directly in the patches directory are always applied, subdirectories named after a version constraint
+// (e.g patches/openssh/>=9.0/) only when the tag satisfies it, and then any patch_sets whose tag regex matches.
+func selectPatches(pkg *Package) (patches []string, err error) {
+
+	if len(pkg.Patches) != 0 {
+		if !directoryExists(pkg.Patches) {
+			return nil, fmt.Errorf("Patches directory doesnt exist: %s", pkg.Patches)
+		}
+
+		p, err := patchFiles(pkg.Patches)
+		if err != nil {
+			return nil, err
+		}
+		patches = append(patches, p...)
+
+		dirList, err := os.ReadDir(pkg.Patches)
+		if err != nil {
+			return nil, err
+		}
+
+		version, versionOk := parseVersion(pkg.Tag)
+		for _, entry := range dirList {
+			if !entry.IsDir() || !isVersionConstraint(entry.Name()) {
+				continue
+			}
+
+			constraint, err := parseVersionConstraint(entry.Name())
+			if err != nil {
+				return nil, fmt.Errorf("Patch directory %s: %s", filepath.Join(pkg.Patches, entry.Name()), err)
+			}
+
+			if !versionOk {
+				log.Printf("[WARN] Package [%s] tag '%s' is not a version, skipping patches in %s\n", pkg.Name, pkg.Tag, entry.Name())
+				continue
+			}
+
+			if !constraint.Matches(version) {
+				continue
+			}
+
+			p, err := patchFiles(filepath.Join(pkg.Patches, entry.Name()))
+			if err != nil {
+				return nil, err
+			}
+			patches = append(patches, p...)
+		}
+	}
+
+	tagRegexes := make([]string, 0, len(pkg.PatchSets))
+	for k := range pkg.PatchSets {
+		tagRegexes = append(tagRegexes, k)
+	}
+	sort.Strings(tagRegexes)
+
+	for _, tagRegex := range tagRegexes {
+		reg, err := regexp.Compile(tagRegex)
+		if err != nil {
+			return nil, fmt.Errorf("Package [%s] has an invalid patch set regex '%s': %s", pkg.Name, tagRegex, err)
+		}
+
+		if !reg.MatchString(pkg.Tag) {
+			continue
+		}
+
+		directory := pkg.PatchSets[tagRegex]
+		if !directoryExists(directory) {
+			return nil, fmt.Errorf("Patches directory doesnt exist: %s", directory)
+		}
+
+		p, err := patchFiles(directory)
+		if err != nil {
+			return nil, err
+		}
+		patches = append(patches, p...)
+	}
+
+	return patches, nil
+}
+
+// patchFiles lists the .patch files in a single directory, in name order
+func patchFiles(directory string) (patches []string, err error) {
+	dirList, err := os.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range dirList {
+		if file.Type().IsRegular() && filepath.Ext(file.Name()) == ".patch" {
+			patchPath, err := filepath.Abs(filepath.Join(directory, file.Name()))
+			if err != nil {
+				return nil, err
+			}
+
+			patches = append(patches, patchPath)
+		}
+	}
+
+	return patches, nil
+}
+
+func applyPatches(pkg *Package) error {
+	patches, err := selectPatches(pkg)
+	if err != nil {
+		return err
+	}
+
+	if len(patches) == 0 {
+		return nil
+	}
+
+	fmt.Printf("Package [%s] has patches for '%s', applying them:\n", pkg.Name, pkg.Tag)
+
+	for _, patchPath := range patches {
+		fmt.Printf("Applying [%s]...", patchPath)
+		cmd := exec.Command("patch", "-f", "-p0", "-d", pkg.Source, "-i", patchPath)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		err = cmd.Run()
+		if err != nil {
+			fmt.Printf("Failed!\n")
+			continue
+		}
+		fmt.Printf("Done!\n")
+	}
+
+	return nil
+}
@@ -1,23 +1,54 @@
 package main
 
 import (
-	"encoding/json"
-	"io/ioutil"
+	"fmt"
+	"regexp"
 	"strings"
 )
 
 type Package struct {
 	Name                 string
-	Repository           string   `json:"repo"`
-	ValidTagRegex        string   `json:"tag_regex"`
-	Source               string   `json:"source_directory"`
-	ConfigurationOptions string   `json:"configure_opts"`
-	Depends              []string `json:"depends"`
-	Install              string   `json:"install"`
-	Build                string   `json:"build"`
-	Patches              string   `json:"patches"`
+	Repository           string            `json:"repo"`
+	SourceType           string            `json:"source_type"` // "github" (default) downloads archives, "git" clones, "path" uses a local directory
+	Path                 string            `json:"path"`        // Local directory for "path" sources
+	PathMode             string            `json:"path_mode"`   // "reference" (default) builds in place, "copy" builds a copy in source/
+	ValidTagRegex        string            `json:"tag_regex"`
+	Version              string            `json:"version"`       // Exact tag, branch, commit or a constraint like ">=1.2.11 <1.3"
+	ReleaseAsset         string            `json:"release_asset"` // Download the release asset matching this pattern instead of the generated archive
+	StripComponents      int               `json:"strip_components"`
+	Mirrors              []string          `json:"mirrors"`          // Urls tried in order before upstream, after the global mirrors
+	MirrorDirectory      string            `json:"mirror_directory"` // Local directory of archives, laid out like a vendor directory
+	Source               string            `json:"source_directory"`
+	ConfigurationOptions string            `json:"configure_opts"`
+	Depends              []string          `json:"depends"`
+	Install              string            `json:"install"`
+	Build                string            `json:"build"`
+	Patches              string            `json:"patches"`
+	PatchSets            map[string]string `json:"patch_sets"` // Tag regex -> patch directory
+	Signature            signatureSettings `json:"signature"`  // Keys downloads have to be signed with
+
+	githubEndpoints
+
+	// Filled in when the package is fetched
+	Tag           string    `json:"-"`
+	Commit        string    `json:"-"`
+	Archive       string    `json:"-"`
+	ArchiveSHA256 string    `json:"-"`
+	ArchiveURL    string    `json:"-"` // Upstream url of the locked archive
+	Progress      *transfer `json:"-"`
+	Fingerprint   string    `json:"-"` // Of the files in a "path" source
+	Changed       bool      `json:"-"` // A "path" source has changed, so it has to be configured even with -build
 }
 
+const (
+	githubSource = "github"
+	gitSource    = "git"
+	pathSource   = "path"
+
+	referencePath = "reference"
+	copyPath      = "copy"
+)
+
 type Image struct {
 	Filename             string   `json:"image_name"`
 	CrossCompilerLibRoot string   `json:"cross_compiler_lib_root"`
@@ -27,30 +58,64 @@ type Image struct {
 }
 
 type pkgManifest struct {
+	Schema string `json:"$schema"` // For editors, see pkg.schema.json
+
+	// Pkg files and directories of package definitions this one is merged over, see include.go
+	Include []string `json:"include"`
+
 	Replacements  map[string]string `json:"replacements"`
-	OauthToken    string            `json:"oauth_token"`
+	OauthToken    string            `json:"oauth_token"` // Prefer GITHUB_TOKEN or -token-file, so the token isnt committed with the pkg file
 	Packages      []*Package        `json:"packages"`
 	CrossCompiler string            `json:"cross_compiler"`
 	ImageSettings Image             `json:"image_settings"`
+
+	KeepOldSources bool `json:"keep_old_sources"` // Dont delete a packages previous source tree when it moves to a new version
+
+	// Used by every package, packages own mirrors are tried first and their own mirror_directory replaces this one
+	Mirrors         []string `json:"mirrors"`
+	MirrorDirectory string   `json:"mirror_directory"`
+
+	Network networkSettings `json:"network"`
+
+	githubEndpoints // Defaults for every github package
+
+	// Command that prints the token for the host given as its argument, or "git" to use git credential fill
+	CredentialHelper string `json:"credential_helper"`
 }
 
 func loadPackageManifest(path string) (settings pkgManifest, err error) {
-	pkgFile, err := ioutil.ReadFile(path)
+	settings, idx, problems, err := readManifest(path)
 	if err != nil {
 		return settings, err
 	}
 
-	err = json.Unmarshal([]byte(pkgFile), &settings)
+	if len(problems) != 0 {
+		return settings, idx.errorOf(problems)
+	}
+
+	return settings, settings.prepare()
+}
+
+// prepare fills in the replacements and defaults, and checks the settings the rest of the program relies on
+func (settings *pkgManifest) prepare() error {
+	err := settings.Network.configure()
 	if err != nil {
-		return settings, err
+		return err
 	}
 
+	auth.manifestToken = settings.OauthToken
+	auth.helper = settings.CredentialHelper
+
 	for k, v := range settings.Replacements {
 		for i := range settings.Packages {
 			settings.Packages[i].ConfigurationOptions = strings.ReplaceAll(settings.Packages[i].ConfigurationOptions, "$"+k+"$", v)
 			settings.Packages[i].Build = strings.ReplaceAll(settings.Packages[i].Build, "$"+k+"$", v)
 			settings.Packages[i].Install = strings.ReplaceAll(settings.Packages[i].Install, "$"+k+"$", v)
+			settings.Packages[i].Path = strings.ReplaceAll(settings.Packages[i].Path, "$"+k+"$", v)
+			settings.Packages[i].Source = strings.ReplaceAll(settings.Packages[i].Source, "$"+k+"$", v)
+			settings.Packages[i].MirrorDirectory = strings.ReplaceAll(settings.Packages[i].MirrorDirectory, "$"+k+"$", v)
 		}
+		settings.MirrorDirectory = strings.ReplaceAll(settings.MirrorDirectory, "$"+k+"$", v)
 	}
 
 	for i := range settings.Packages {
@@ -59,5 +124,100 @@ func loadPackageManifest(path string) (settings pkgManifest, err error) {
 		settings.Packages[i].Install = strings.ReplaceAll(settings.Packages[i].Install, "$cross_compiler$", settings.CrossCompiler)
 	}
 
-	return settings, nil
+	for _, pkg := range settings.Packages {
+		// source_directory used to only be settable by hand editing the source cache, treat it as a local path
+		if len(pkg.Path) == 0 && len(pkg.Source) != 0 {
+			pkg.Path = pkg.Source
+		}
+
+		switch pkg.SourceType {
+		case "":
+			pkg.SourceType = githubSource
+			if len(pkg.Path) != 0 {
+				pkg.SourceType = pathSource
+			}
+		case githubSource, gitSource, pathSource:
+		default:
+			return fmt.Errorf("Package [%s] has an unknown source_type '%s'", pkg.Name, pkg.SourceType)
+		}
+
+		pkg.Mirrors = append(pkg.Mirrors, settings.Mirrors...)
+		for _, mirror := range pkg.Mirrors {
+			if err := checkMirror(mirror); err != nil {
+				return fmt.Errorf("Package [%s] %s", pkg.Name, err)
+			}
+		}
+
+		if len(pkg.MirrorDirectory) == 0 {
+			pkg.MirrorDirectory = settings.MirrorDirectory
+		}
+
+		if pkg.SourceType == githubSource {
+			if err := pkg.setEndpoints(settings.githubEndpoints); err != nil {
+				return err
+			}
+		}
+
+		if err := pkg.Signature.check(pkg.SourceType); err != nil {
+			return fmt.Errorf("Package [%s] %s", pkg.Name, err)
+		}
+
+		if len(pkg.ReleaseAsset) != 0 && pkg.SourceType != githubSource {
+			return fmt.Errorf("Package [%s] release_asset is only supported for github sources", pkg.Name)
+		}
+
+		if pkg.SourceType == pathSource {
+			if len(pkg.Path) == 0 {
+				return fmt.Errorf("Package [%s] is a path source but has no path", pkg.Name)
+			}
+
+			switch pkg.PathMode {
+			case "":
+				pkg.PathMode = referencePath
+			case referencePath, copyPath:
+			default:
+				return fmt.Errorf("Package [%s] has an unknown path_mode '%s'", pkg.Name, pkg.PathMode)
+			}
+
+			if pkg.PathMode == referencePath && (len(pkg.Patches) != 0 || len(pkg.PatchSets) != 0) {
+				return fmt.Errorf("Package [%s] has patches, which would modify %s in place. Use \"path_mode\": \"copy\"", pkg.Name, pkg.Path)
+			}
+		}
+
+		if isVersionConstraint(pkg.Version) {
+			if _, err := parseVersionConstraint(pkg.Version); err != nil {
+				return fmt.Errorf("Package [%s]: %s", pkg.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// satisfiedBy checks whether a previously fetched tag and commit is still what the package asks for, so that changing
+// the version in the manifest causes a new download
+func (p *Package) satisfiedBy(tag, commit string) bool {
+	// Like resolveVersion, the regex only filters the tags to pick from, an exact tag, branch or commit is used as is
+	if len(p.ValidTagRegex) != 0 && (len(p.Version) == 0 || isVersionConstraint(p.Version)) {
+		reg, err := regexp.Compile(p.ValidTagRegex)
+		if err != nil || !reg.MatchString(tag) {
+			return false
+		}
+	}
+
+	if len(p.Version) == 0 {
+		return true
+	}
+
+	if isVersionConstraint(p.Version) {
+		constraint, err := parseVersionConstraint(p.Version)
+		if err != nil {
+			return false
+		}
+
+		v, ok := parseVersion(tag)
+		return ok && constraint.Matches(v)
+	}
+
+	return tag == p.Version || (commitHashRegex.MatchString(p.Version) && strings.HasPrefix(commit, strings.ToLower(p.Version)))
 }
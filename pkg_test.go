@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestSatisfiedBy(t *testing.T) {
+	const commit = "0123456789abcdef0123456789abcdef01234567"
+
+	tests := []struct {
+		version string
+		regex   string
+		tag     string
+		want    bool
+	}{
+		{"", "", "v1.2.13", true},
+		{"", `^v1\.`, "v1.2.13", true},
+		{"", `^v2\.`, "v1.2.13", false},
+
+		// The regex only narrows down the tags to pick from, it doesnt apply to an exact tag, branch or commit
+		{"v1.2.13", "", "v1.2.13", true},
+		{"v1.2.13", `^release-`, "v1.2.13", true},
+		{"v1.2.13", "", "v1.2.12", false},
+		{"v1.2.13", `^release-`, "v1.2.12", false},
+		{"main", "", "main", true},
+		{"main", `^v[0-9.]+$`, "main", true},
+		{"develop", "", "main", false},
+		{"0123456", "", "0123456", true},
+		{"0123456", `^v[0-9.]+$`, "0123456", true},
+		{"0123456789ABCDEF", "", "v1.2.13", true}, // Fetched at that commit under another name
+		{"fedcba9", "", "v1.2.13", false},
+		{"fedcba9", `^v1\.`, "v1.2.13", false},
+
+		{">=1.2.11 <1.3", "", "v1.2.13", true},
+		{">=1.2.11 <1.3", `^v1\.2\.`, "v1.2.13", true},
+		{">=1.2.11 <1.3", `^release-`, "v1.2.13", false},
+		{">=1.2.11 <1.3", "", "v1.3.0", false},
+		{">=1.2.11 <1.3", "", "main", false},
+	}
+
+	for _, test := range tests {
+		p := Package{Name: "zlib", Version: test.version, ValidTagRegex: test.regex}
+		if got := p.satisfiedBy(test.tag, commit); got != test.want {
+			t.Errorf("version %q regex %q satisfied by %s = %v, want %v", test.version, test.regex, test.tag, got, test.want)
+		}
+	}
+}
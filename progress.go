@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressReporter shows how far along each download is. On a terminal that is a status line that is kept up to date,
+// otherwise (a log file, ci) a line per download every few seconds. Anything else printed while downloads are running
+// should go through printf so it doesnt get mixed up with the status line
+type progressReporter struct {
+	sync.Mutex
+
+	out       io.Writer
+	terminal  bool
+	transfers []*transfer
+	shown     bool // Whether the status line is currently on screen
+
+	// For the summary
+	downloaded  int64
+	downloads   int
+	cacheHits   int
+	notModified int
+
+	stop, stopped chan struct{}
+	closing       sync.Once
+}
+
+// transfer is one download, its methods can be called on nil for downloads nobody is watching
+type transfer struct {
+	reporter *progressReporter
+	name     string
+
+	total, done int64 // total is -1 if the server didnt say
+	reported    int64 // done when it was last printed, without a terminal
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// activeProgress is the reporter of the downloads that are running, if there are any, for warnf
+var activeProgress struct {
+	sync.Mutex
+	reporter *progressReporter
+}
+
+// warnf prints a warning or retry from somewhere deep in a download, through the progress reporter while downloads are
+// running so it doesnt get mixed up with the status line, or to stderr otherwise
+func warnf(format string, args ...interface{}) {
+	activeProgress.Lock()
+	reporter := activeProgress.reporter
+	activeProgress.Unlock()
+
+	if reporter != nil {
+		reporter.printf(format, args...)
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, format, args...)
+}
+
+func newProgressReporter() *progressReporter {
+	return startProgressReporter(os.Stdout, isTerminal(os.Stdout))
+}
+
+func startProgressReporter(out io.Writer, terminal bool) *progressReporter {
+	p := &progressReporter{
+		out:      out,
+		terminal: terminal,
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+
+	activeProgress.Lock()
+	activeProgress.reporter = p
+	activeProgress.Unlock()
+
+	interval := 5 * time.Second
+	if p.terminal {
+		interval = 200 * time.Millisecond
+	}
+
+	go func() {
+		defer close(p.stopped)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				p.Lock()
+				p.render()
+				p.Unlock()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+
+	return p
+}
+
+// close stops updating the status line, and removes it
+func (p *progressReporter) close() {
+	p.closing.Do(func() {
+		close(p.stop)
+		<-p.stopped
+
+		activeProgress.Lock()
+		if activeProgress.reporter == p {
+			activeProgress.reporter = nil
+		}
+		activeProgress.Unlock()
+
+		p.Lock()
+		defer p.Unlock()
+		p.clear()
+	})
+}
+
+func (p *progressReporter) printf(format string, args ...interface{}) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.clear()
+	fmt.Fprintf(p.out, format, args...)
+	if p.terminal {
+		p.render()
+	}
+}
+
+func (p *progressReporter) cacheHit() {
+	p.Lock()
+	defer p.Unlock()
+	p.cacheHits++
+}
+
+func (p *progressReporter) start(name string) *transfer {
+	p.Lock()
+	defer p.Unlock()
+
+	t := &transfer{reporter: p, name: name, total: -1}
+	p.transfers = append(p.transfers, t)
+	return t
+}
+
+func (p *progressReporter) summary() string {
+	p.Lock()
+	defer p.Unlock()
+
+	return fmt.Sprintf("Downloaded %s for %d package(s), %d already cached, %d unchanged on the server", formatBytes(p.downloaded), p.downloads, p.cacheHits, p.notModified)
+}
+
+func (p *progressReporter) clear() {
+	if p.terminal && p.shown {
+		fmt.Fprint(p.out, "\r\033[K")
+		p.shown = false
+	}
+}
+
+// render draws the status line, or without a terminal prints the downloads that have moved on since last time
+func (p *progressReporter) render() {
+	if len(p.transfers) == 0 {
+		return
+	}
+
+	if !p.terminal {
+		for _, t := range p.transfers {
+			if t.done != t.reported {
+				fmt.Fprintf(p.out, "[Progress %s] %s\n", t.name, t.describe())
+				t.reported = t.done
+			}
+		}
+		return
+	}
+
+	parts := []string{}
+	for _, t := range p.transfers {
+		parts = append(parts, t.name+" "+t.describe())
+	}
+
+	line := "Downloading " + strings.Join(parts, ", ")
+
+	width, err := strconv.Atoi(os.Getenv("COLUMNS"))
+	if err != nil || width <= 0 {
+		width = 80
+	}
+	if len(line) > width-1 {
+		line = line[:width-4] + "..."
+	}
+
+	fmt.Fprint(p.out, "\r\033[K"+line)
+	p.shown = true
+}
+
+func (t *transfer) describe() string {
+	if t.total <= 0 {
+		return formatBytes(t.done)
+	}
+	return fmt.Sprintf("%s/%s (%d%%)", formatBytes(t.done), formatBytes(t.total), t.done*100/t.total)
+}
+
+// start of a response, so a retry or fallback to another mirror starts counting again
+func (t *transfer) setTotal(total int64) {
+	if t == nil {
+		return
+	}
+
+	t.reporter.Lock()
+	defer t.reporter.Unlock()
+	t.total = total
+	t.done, t.reported = 0, 0
+}
+
+// unchanged records that the server said our cached copy is still current
+func (t *transfer) unchanged() {
+	if t == nil {
+		return
+	}
+
+	t.reporter.Lock()
+	defer t.reporter.Unlock()
+	t.reporter.notModified++
+}
+
+func (t *transfer) add(n int64) {
+	t.reporter.Lock()
+	defer t.reporter.Unlock()
+	t.done += n
+	t.reporter.downloaded += n
+}
+
+// finish removes the transfer from the status line
+func (t *transfer) finish() {
+	if t == nil {
+		return
+	}
+
+	p := t.reporter
+	p.Lock()
+	defer p.Unlock()
+
+	for i := range p.transfers {
+		if p.transfers[i] == t {
+			p.transfers = append(p.transfers[:i], p.transfers[i+1:]...)
+			break
+		}
+	}
+
+	if t.done > 0 {
+		p.downloads++
+	}
+}
+
+// reader counts whatever is read through it towards the transfer
+func (t *transfer) reader(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return progressReader{r, t}
+}
+
+type progressReader struct {
+	io.Reader
+	t *transfer
+}
+
+func (r progressReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		r.t.add(int64(n))
+	}
+	return n, err
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
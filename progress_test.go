@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestProgressWithoutTerminal(t *testing.T) {
+	out := &bytes.Buffer{}
+	p := startProgressReporter(out, false)
+
+	tool := p.start("tool")
+	tool.setTotal(2048)
+	tool.reader(strings.NewReader(strings.Repeat("x", 1024))).Read(make([]byte, 4096))
+
+	other := p.start("other")
+	other.unchanged()
+
+	warnf("[Retry] %s: %s\n", "https://example.com/tool.tar.gz", "connection reset")
+
+	p.Lock()
+	p.render()
+	p.render() // Nothing has moved on, so nothing more is printed
+	p.Unlock()
+
+	tool.finish()
+	other.finish()
+	p.cacheHit()
+	p.close()
+
+	// Once closed warnings go back to stderr
+	warnf("[WARN] not for the reporter\n")
+
+	want := "[Retry] https://example.com/tool.tar.gz: connection reset\n" +
+		"[Progress tool] 1.0 KiB/2.0 KiB (50%)\n"
+	if out.String() != want {
+		t.Errorf("Without a terminal there should be plain lines and no status line, got:\n%q\nwant:\n%q", out.String(), want)
+	}
+
+	if summary := p.summary(); summary != "Downloaded 1.0 KiB for 1 package(s), 1 already cached, 1 unchanged on the server" {
+		t.Errorf("Summary is %s", summary)
+	}
+}
+
+func TestProgressOnTerminal(t *testing.T) {
+	out := &bytes.Buffer{}
+	p := startProgressReporter(out, true)
+
+	tool := p.start("tool")
+	tool.setTotal(-1)
+	tool.add(100)
+
+	p.Lock()
+	p.render()
+	p.Unlock()
+
+	p.printf("[Downloaded %s]\n", "tool")
+	tool.finish()
+	p.close()
+
+	// The status line is cleared before anything else is printed, redrawn after, and cleared at the end
+	printed := "\r\033[K[Downloaded tool]\n\r\033[KDownloading tool 100 B"
+	if !strings.Contains(out.String(), printed) || !strings.HasSuffix(out.String(), "\r\033[K") {
+		t.Errorf("Got %q, want it to contain %q", out.String(), printed)
+	}
+}
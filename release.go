@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+type releaseAsset struct {
+	Name        string `json:"name"`
+	DownloadURL string `json:"browser_download_url"`
+	Digest      string `json:"digest"` // "sha256:<hex>", only present on assets uploaded recently
+}
+
+type release struct {
+	TagName string         `json:"tag_name"`
+	Assets  []releaseAsset `json:"assets"`
+}
+
+// Names projects commonly use for a file of checksums covering every asset in a release
+var checksumAssets = []string{"SHA256SUMS", "SHA256SUMS.txt", "sha256sums.txt", "checksums.txt", "sha256sum.txt"}
+
+func getRelease(api, owner, name, tag string) (r release, err error) {
+	resp, err := apiClient().Get(fmt.Sprintf("%s/repos/%s/%s/releases/tags/%s", api, owner, name, url.PathEscape(tag)))
+	if err != nil {
+		return r, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return r, fmt.Errorf("%s/%s has no release for tag %s", owner, name, tag)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return r, githubError(fmt.Errorf("Getting release %s of %s/%s failed: %s", tag, owner, name, resp.Status))
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	return r, err
+}
+
+// fetchReleaseAsset downloads the release asset matching the packages release_asset pattern, for the packages resolved tag
+// The download is checked against the assets published digest, or a checksum file in the same release, when either exists
+func fetchReleaseAsset(p Package, owner, name string) (fetched fetchedSource, err error) {
+	// A locked asset is checked against the lock file, so there is no need to ask the api (which may be what is down) about it again
+	if matched, _ := path.Match(p.ReleaseAsset, path.Base(p.ArchiveURL)); matched && len(p.ArchiveSHA256) != 0 {
+		return downloadReleaseAsset(p, p.ArchiveURL, "")
+	}
+
+	r, err := getRelease(p.APIURL, owner, name, p.Tag)
+	if err != nil {
+		return fetched, err
+	}
+
+	var asset *releaseAsset
+	var names []string
+	for i := range r.Assets {
+		names = append(names, r.Assets[i].Name)
+
+		matched, err := path.Match(p.ReleaseAsset, r.Assets[i].Name)
+		if err != nil {
+			return fetched, fmt.Errorf("Package [%s] release_asset pattern '%s' is invalid: %s", p.Name, p.ReleaseAsset, err)
+		}
+
+		if matched && asset == nil {
+			asset = &r.Assets[i]
+		}
+	}
+
+	if asset == nil {
+		return fetched, fmt.Errorf("No asset in release %s of %s/%s matches '%s', assets are: %s", p.Tag, owner, name, p.ReleaseAsset, strings.Join(names, ", "))
+	}
+
+	expected, err := publishedChecksum(r, *asset)
+	if err != nil {
+		return fetched, err
+	}
+
+	if len(expected) == 0 {
+		warnf("[WARN] No published checksum for %s, using it unverified\n", asset.Name)
+	}
+
+	return downloadReleaseAsset(p, asset.DownloadURL, expected)
+}
+
+// downloadReleaseAsset downloads an asset, checking it against the published sha256 if there is one
+func downloadReleaseAsset(p Package, assetURL, published string) (fetched fetchedSource, err error) {
+	outputFile := filepath.Join("source", path.Base(assetURL))
+
+	fetched.SHA256, err = downloadArchive(p, outputFile, assetURL, published)
+	if err != nil {
+		return fetched, err
+	}
+
+	fetched.Path, err = filepath.Abs(outputFile)
+	if err != nil {
+		return fetched, err
+	}
+
+	fetched.Tag = p.Tag
+	fetched.Commit = p.Commit
+	fetched.URL = assetURL
+
+	return fetched, nil
+}
+
+// publishedChecksum finds the sha256 the project published for an asset, either from github or a checksum file
+// Returns an empty string if there isnt one
+func publishedChecksum(r release, asset releaseAsset) (string, error) {
+	if strings.HasPrefix(asset.Digest, "sha256:") {
+		return strings.TrimPrefix(asset.Digest, "sha256:"), nil
+	}
+
+	candidates := []string{asset.Name + ".sha256", asset.Name + ".sha256sum"}
+	candidates = append(candidates, checksumAssets...)
+
+	for _, candidate := range candidates {
+		for _, a := range r.Assets {
+			if a.Name != candidate {
+				continue
+			}
+
+			resp, err := downloadClient().Get(a.DownloadURL)
+			if err != nil {
+				return "", err
+			}
+
+			contents, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				return "", err
+			}
+
+			if resp.StatusCode != http.StatusOK {
+				return "", fmt.Errorf("Downloading checksum file %s failed: %s", a.Name, resp.Status)
+			}
+
+			if sum := findChecksum(string(contents), asset.Name); len(sum) != 0 {
+				return sum, nil
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// findChecksum reads sha256sum style output ("<hex>  <name>" or "<hex> *<name>"), a single bare hash is assumed to be for the file we want
+func findChecksum(contents, name string) string {
+	scanner := bufio.NewScanner(strings.NewReader(contents))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		switch {
+		case len(fields) == 1 && len(fields[0]) == 64:
+			return fields[0]
+		case len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name:
+			return fields[0]
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestFindChecksum(t *testing.T) {
+	sum := sha256Hex("tool")
+	other := sha256Hex("other")
+
+	tests := []struct {
+		contents string
+		want     string
+	}{
+		{sum + "  tool-linux.tar.gz\n", sum},
+		{other + "  tool-darwin.tar.gz\n" + sum + " *tool-linux.tar.gz\n", sum},
+		{sum + "\n", sum},
+		{other + "  tool-darwin.tar.gz\n", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if got := findChecksum(test.contents, "tool-linux.tar.gz"); got != test.want {
+			t.Errorf("findChecksum(%q) = %s, want %s", test.contents, got, test.want)
+		}
+	}
+}
+
+func TestFetchReleaseAsset(t *testing.T) {
+	inDirectory(t, t.TempDir())
+	for _, dir := range []string{"source", "cache"} {
+		if err := os.Mkdir(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files := map[string]string{"tool-linux.tar.gz": "tool"}
+	releases := map[string]release{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if name := strings.TrimPrefix(r.URL.Path, "/download/"); name != r.URL.Path {
+			contents, ok := files[name]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("ETag", `"`+sha256Hex(contents)+`"`)
+			fmt.Fprint(w, contents)
+			return
+		}
+
+		// The tag is escaped, so a tag with a slash in it is still one path segment
+		tag := strings.TrimPrefix(r.URL.EscapedPath(), "/repos/owner/tool/releases/tags/")
+		found, ok := releases[tag]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(found)
+	}))
+	defer server.Close()
+
+	asset := func(name, digest string) releaseAsset {
+		return releaseAsset{Name: name, DownloadURL: server.URL + "/download/" + name, Digest: digest}
+	}
+
+	files["SHA256SUMS"] = sha256Hex("other") + "  tool-darwin.tar.gz\n" + sha256Hex("tool") + "  tool-linux.tar.gz\n"
+	files["checksums.txt"] = sha256Hex("not the tool") + "  tool-linux.tar.gz\n"
+
+	releases["v1.0"] = release{Assets: []releaseAsset{asset("tool-linux.tar.gz", "sha256:"+sha256Hex("tool"))}}
+	releases["v2.0"] = release{Assets: []releaseAsset{asset("tool-linux.tar.gz", ""), asset("SHA256SUMS", "")}}
+	releases["v3.0"] = release{Assets: []releaseAsset{asset("tool-linux.tar.gz", "sha256:"+sha256Hex("not the tool"))}}
+	releases["release%2F4.0"] = release{Assets: []releaseAsset{asset("tool-linux.tar.gz", "")}}
+
+	p := Package{Name: "tool", ReleaseAsset: "tool-linux*", githubEndpoints: githubEndpoints{APIURL: server.URL}}
+
+	tests := []struct {
+		tag string
+		err string
+	}{
+		{"v1.0", ""},
+		{"v2.0", ""},
+		{"release/4.0", ""}, // Unverified, there is nothing published to check it against
+		{"v9.9", "has no release for tag v9.9"},
+		{"v3.0", "failed verification"},
+	}
+
+	for _, test := range tests {
+		p.Tag = test.tag
+		fetched, err := fetchReleaseAsset(p, "owner", "tool")
+
+		switch {
+		case len(test.err) != 0 && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s should fail with %q, got %v", test.tag, test.err, err)
+		case len(test.err) == 0 && err != nil:
+			t.Errorf("%s: %s", test.tag, err)
+		case len(test.err) == 0 && fetched.SHA256 != sha256Hex("tool"):
+			t.Errorf("%s downloaded sha256 %s", test.tag, fetched.SHA256)
+		}
+	}
+
+	// The bad download is forgotten along with its cached copy, so the next run downloads it again rather than trusting it
+	assetURL := server.URL + "/download/tool-linux.tar.gz"
+	if Exists(filepath.Join("source", "tool-linux.tar.gz")) || Exists(httpCachePath(assetURL)) || Exists(objectPath(sha256Hex("tool"))) {
+		t.Errorf("A download that failed verification was left behind")
+	}
+
+	releases["v3.0"] = release{Assets: []releaseAsset{asset("tool-linux.tar.gz", ""), asset("checksums.txt", "")}}
+	p.Tag = "v3.0"
+	if _, err := fetchReleaseAsset(p, "owner", "tool"); err == nil || !strings.Contains(err.Error(), "failed verification") {
+		t.Errorf("A checksum file that doesnt match should fail verification, got %v", err)
+	}
+
+	files["checksums.txt"] = files["SHA256SUMS"]
+	if fetched, err := fetchReleaseAsset(p, "owner", "tool"); err != nil || fetched.SHA256 != sha256Hex("tool") {
+		t.Errorf("Once the checksum is fixed the asset should download again, got %s %v", fetched.SHA256, err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join("source", "tool-linux.tar.gz")); err != nil || string(b) != "tool" {
+		t.Errorf("Asset is %q %v", b, err)
+	}
+}
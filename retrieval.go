@@ -1,26 +1,17 @@
 package main
 
 import (
-	"archive/tar"
-	"compress/gzip"
 	"context"
-	"crypto/sha1"
-	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"io/fs"
 	"io/ioutil"
-	"net/http"
-	"net/url"
+	"log"
 	"os"
-	"path"
+	"os/signal"
 	"path/filepath"
-	"regexp"
+	"runtime"
 	"strings"
-
-	"github.com/shurcooL/githubv4"
-	"golang.org/x/oauth2"
+	"sync"
 )
 
 const sourceCacheFile = "./source/valid_sources"
@@ -32,11 +23,31 @@ func directoryExists(path string) bool {
 	return true
 }
 
-func pullPackages(oauth string, packages []*Package) error {
+// offlineError is for something that would have to be fetched while offline
+func offlineError(what string) error {
+	return fmt.Errorf("%s isnt in source/, cache/ or the vendor directory and we are offline", what)
+}
 
-	if len(oauth) == 0 {
-		return fmt.Errorf("No ouath token specified")
-	}
+type pullOptions struct {
+	LockFile string
+
+	// Re-extract every package from its archive, rather than reusing a tree that may have been patched or built in
+	Fresh bool
+
+	// Leave the previous source tree of a package in source/ when it moves to a new version
+	KeepOldSources bool
+
+	// Never touch the network, everything has to come from source/, cache/ or the vendor directory
+	Offline bool
+
+	// Directory written by the vendor command, archives are taken from here rather than downloaded
+	Vendor string
+
+	// How many packages are downloaded at once
+	Jobs int
+}
+
+func pullPackages(packages []*Package, options pullOptions) error {
 
 	if !directoryExists("source") && os.Mkdir("source", 0700) != nil {
 		return fmt.Errorf("Unable to make source directory")
@@ -46,307 +57,518 @@ func pullPackages(oauth string, packages []*Package) error {
 		return fmt.Errorf("Unable to make cache directory")
 	}
 
-	cachedPackageSources := make(map[string]string)
+	removeIncompleteSources()
+
+	cachedPackageSources, err := loadSourceCache()
+	if err != nil {
+		return err
+	}
 
-	source, err := ioutil.ReadFile(sourceCacheFile)
-	if err == nil {
+	if len(cachedPackageSources) != 0 {
 		fmt.Printf("Cache exists, using cached resources\n")
-		err = json.Unmarshal(source, &cachedPackageSources)
+	}
+
+	lock, err := loadLockFile(options.LockFile)
+	if err != nil {
+		return err
+	}
+
+	if len(options.Vendor) != 0 {
+		vendored, err := loadLockFile(filepath.Join(options.Vendor, vendorLockFile))
 		if err != nil {
 			return err
 		}
+
+		// The vendored lock fills in for a lock file that didnt get shipped along with the pkg file
+		for name, locked := range vendored {
+			if _, ok := lock[name]; !ok {
+				lock[name] = locked
+			}
+		}
 	}
 
+	progress := newProgressReporter()
+	defer progress.close()
+
+	pending := []pendingFetch{}
 	for _, pkg := range packages {
-		if _, ok := cachedPackageSources[pkg.Name]; !ok { // TODO add check to make sure that source/ actually has the files
-			fmt.Printf("[Missing %s] Downloading %s...", pkg.Name, pkg.Repository)
-			pkg.Source, err = fetch(*pkg, oauth)
+		if pkg.SourceType == pathSource {
+			cached := cachedPackageSources[pkg.Name]
+			if options.Fresh {
+				cached = cachedSource{}
+			}
+
+			err = pullLocal(pkg, cached)
 			if err != nil {
 				return err
 			}
-			fmt.Printf("Done!\n")
-		} else {
-			pkg.Source = cachedPackageSources[pkg.Name]
-			fmt.Printf("[Found %s] %s\n", pkg.Name, pkg.Source)
+			continue
+		}
+
+		locked, isLocked := lock[pkg.Name]
+		if isLocked && !pkg.satisfiedBy(locked.Tag, locked.Commit) {
+			fmt.Printf("[Changed %s] Locked version %s no longer satisfies the manifest\n", pkg.Name, locked.Tag)
+			isLocked = false
+		}
+
+		// A package with a signature that hasnt been checked yet (it was locked before the signature was added), or was signed
+		// by a key that has since been removed, is downloaded again
+		verified := !pkg.Signature.enabled() || isLocked && pkg.Signature.signedByCurrentKey(locked.SignedBy)
+		if isLocked && !verified {
+			fmt.Printf("[Unverified %s] Fetching it again to check its signature\n", pkg.Name)
+		}
+
+		cached, ok := cachedPackageSources[pkg.Name]
+		if ok && verified && pkg.satisfiedBy(cached.Tag, cached.Commit) && (!isLocked || cached.Commit == locked.Commit) {
+			pkg.Source = cached.Source
+			pkg.Archive = cached.Archive
+			pkg.ArchiveSHA256 = cached.SHA256
+			pkg.Tag = cached.Tag
+			pkg.Commit = cached.Commit
+
+			switch cached.check(options.Fresh) {
+			case useCached:
+				fmt.Printf("[Found %s] %s (%s)\n", pkg.Name, pkg.Source, pkg.Tag)
+				progress.cacheHit()
+				continue
+
+			case reextract:
+				if options.Fresh {
+					fmt.Printf("[Fresh %s] %s (%s)\n", pkg.Name, pkg.Archive, pkg.Tag)
+				} else {
+					fmt.Printf("[Incomplete %s] %s is missing or incomplete, extracting it again\n", pkg.Name, pkg.Source)
+				}
+				pkg.Source = pkg.Archive
+				progress.cacheHit()
+				continue
+
+			default:
+				if !options.Fresh {
+					fmt.Printf("[Damaged %s] Source and archive are missing or corrupt, fetching them again\n", pkg.Name)
+				}
+			}
+
+			// Nothing good to extract again from, so fetch the same version again
+			if !isLocked {
+				isLocked, locked = true, lockedPackage{Tag: cached.Tag, Commit: cached.Commit, SHA256: cached.SHA256}
+			}
+		}
+
+		if isLocked {
+			pkg.Tag, pkg.Commit = locked.Tag, locked.Commit
+			pkg.ArchiveSHA256, pkg.ArchiveURL = locked.SHA256, locked.URL
+		} else if options.Offline {
+			return fmt.Errorf("Package [%s] isnt locked or cached, cant work out which version to use while offline", pkg.Name)
+		}
+
+		// Anything we already have with the locked hash is exactly what a download would give us
+		if archive, ok := findArchive(locked.SHA256, objectPath(locked.SHA256), vendoredArchive(options.Vendor, locked.SHA256), vendoredArchive(pkg.MirrorDirectory, locked.SHA256)); isLocked && verified && ok {
+			fmt.Printf("[Found %s] %s (%s)\n", pkg.Name, archive, pkg.Tag)
+			pkg.Source = archive
+			pkg.Archive = archive
+			pkg.ArchiveSHA256 = locked.SHA256
+			lock[pkg.Name] = locked
+			progress.cacheHit()
+			continue
+		}
+
+		if options.Offline && !verified && pkg.SourceType != gitSource {
+			return fmt.Errorf("Package [%s] signature hasnt been checked yet, which cant be done offline", pkg.Name)
 		}
+
+		if options.Offline && pkg.SourceType != gitSource {
+			return fmt.Errorf("Package [%s] %s", pkg.Name, offlineError(pkg.Tag))
+		}
+
+		pending = append(pending, pendingFetch{pkg: pkg, locked: locked, isLocked: isLocked})
 	}
 
-	fmt.Printf("Extracting archives...")
-	newPackageSources, err := extractPackages(packages)
+	fetched, err := fetchPackages(pending, options, progress)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("Done!\n")
 
-	for k, v := range newPackageSources { // Merge the cached maps as to not trample cached sources in single build mode
-		cachedPackageSources[k] = v
+	for i, entry := range fetched {
+		pkg := pending[i].pkg
+		pkg.Source = entry.Path
+		pkg.Archive = ""
+		pkg.ArchiveSHA256 = entry.SHA256
+		if !directoryExists(entry.Path) {
+			pkg.Archive = entry.Path
+		}
+
+		lock[pkg.Name] = entry.lockedPackage
 	}
 
-	//Write package cache file
-	b, err := json.Marshal(cachedPackageSources)
-	if err != nil {
-		return err
+	progress.close()
+	fmt.Println(progress.summary())
+
+	// Ctrl-C stops the extraction cleanly, rather than leaving temporary directories behind
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	fmt.Printf("Extracting archives...")
+	newPackageSources, extractErr := extractPackages(ctx, packages, runtime.NumCPU())
+	if extractErr != nil {
+		fmt.Printf("Failed!\n")
+	} else {
+		fmt.Printf("Done!\n")
 	}
 
-	err = ioutil.WriteFile(sourceCacheFile, b, 0600)
+	// Packages that were extracted are cached even if others failed, so they arent extracted again next time
+	for _, pkg := range packages { // Merge the cached maps as to not trample cached sources in single build mode
+		source, ok := newPackageSources[pkg.Name]
+		if !ok {
+			continue
+		}
+
+		previous := cachedPackageSources[pkg.Name].Source
+		if !options.KeepOldSources && len(previous) != 0 && previous != source {
+			removeOldSource(previous)
+		}
+
+		cachedPackageSources[pkg.Name] = cachedSource{
+			Source:      source,
+			Archive:     pkg.Archive,
+			SHA256:      pkg.ArchiveSHA256,
+			Stamp:       readStamp(newPackageSources[pkg.Name]),
+			Tag:         pkg.Tag,
+			Commit:      pkg.Commit,
+			Fingerprint: pkg.Fingerprint,
+		}
+	}
+
+	err = writeSourceCache(cachedPackageSources)
 	if err != nil {
 		return err
 	}
 
-	return nil
-}
+	if extractErr != nil {
+		return extractErr
+	}
 
-func fetch(p Package, oauthToken string) (Path string, err error) {
+	return lock.write(options.LockFile)
+}
 
-	auth := oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: oauthToken},
-	)
+// pendingFetch is a package that isnt cached, so has to be downloaded (or checked out)
+type pendingFetch struct {
+	pkg      *Package
+	locked   lockedPackage
+	isLocked bool
+}
 
-	u, err := url.Parse(p.Repository)
-	if err != nil {
-		return
+// fetchPackages downloads packages, options.Jobs at a time. Every package is tried even if some fail, so that all the
+// failures can be reported together
+func fetchPackages(pending []pendingFetch, options pullOptions, progress *progressReporter) ([]fetchedSource, error) {
+	jobs := options.Jobs
+	if jobs < 1 {
+		jobs = 1
 	}
 
-	parts := strings.Split(u.Path[1:], "/")
-	if len(parts) != 2 {
-		return "", fmt.Errorf("Repository %s wasnt in the required https://github/owner/repo format", p.Repository)
-	}
+	fetched := make([]fetchedSource, len(pending))
+	errs := make([]error, len(pending))
 
-	//parts[0] = owner
-	//parts[1] = repo/pkg name
+	slots := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
 
-	tagName, commitHash, err := getLatestPackage(parts[0], parts[1], p.ValidTagRegex, auth)
-	if err != nil {
-		return
+	for i := range pending {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			fetched[i], errs[i] = pending[i].fetch(options, progress)
+		}(i)
 	}
 
-	outputFile := "./source/" + parts[1] + "-" + tagName + ".tar.gz"
+	wg.Wait()
 
-	err = downloadFile(outputFile, fmt.Sprintf("https://github.com/%s/%s/archive/%s.tar.gz", parts[0], parts[1], commitHash))
-	if err != nil {
-		return
+	failures := []error{}
+	for i, err := range errs {
+		if err != nil {
+			failures = append(failures, fmt.Errorf("Package [%s]: %s", pending[i].pkg.Name, err))
+		}
 	}
 
-	return filepath.Abs(outputFile)
+	return fetched, errors.Join(failures...)
 }
 
-func getLatestPackage(owner, name, regex string, oAuth oauth2.TokenSource) (tagName string, commitHash string, err error) {
-
-	httpClient := oauth2.NewClient(context.Background(), oAuth)
-
-	client := githubv4.NewClient(httpClient)
-
-	var query struct {
-		Repository struct {
-			Description string
-			Refs        struct {
-				Edges []struct {
-					Node struct {
-						Target struct {
-							CommitResourcePath githubv4.URI
-							Tag                struct {
-								Name string
-							} `graphql:"... on Tag"`
-						}
-					}
-				}
-			} `graphql:"refs(refPrefix: \"refs/tags/\", last: $number, orderBy: {field: TAG_COMMIT_DATE, direction: ASC})"`
-		} `graphql:"repository(owner: $repoOwner, name: $repoName)"`
+func (f pendingFetch) fetch(options pullOptions, progress *progressReporter) (entry fetchedSource, err error) {
+	pkg := f.pkg
+
+	if !f.isLocked {
+		pkg.Tag, pkg.Commit, err = resolve(*pkg)
+		if err != nil {
+			return entry, err
+		}
 	}
 
-	last := 1
-	if len(regex) != 0 {
-		last = 10
+	if options.Offline {
+		// Only git sources get this far offline, anything else missing has already failed
+		progress.printf("[Missing %s] Checking out %s %s from the mirror\n", pkg.Name, pkg.Repository, pkg.Tag)
+		entry, err = checkoutGit(*pkg, false, options.Vendor, pkg.MirrorDirectory)
+		if err == nil {
+			err = verifyFetched(*pkg, &entry)
+		}
+	} else {
+		progress.printf("[Missing %s] Downloading %s %s\n", pkg.Name, pkg.Repository, pkg.Tag)
+		if pkg.SourceType != gitSource {
+			pkg.Progress = progress.start(pkg.Name)
+		}
+		entry, err = fetch(*pkg)
+		pkg.Progress.finish()
+	}
+	if err != nil {
+		return entry, err
 	}
 
-	variables := map[string]interface{}{
-		"repoOwner": githubv4.String(owner),
-		"repoName":  githubv4.String(name),
-		"number":    githubv4.Int(last),
+	if f.isLocked && len(f.locked.SHA256) != 0 && f.locked.SHA256 != entry.SHA256 {
+		return entry, fmt.Errorf("Archive does not match the lock file, expected sha256 %s got %s", f.locked.SHA256, entry.SHA256)
 	}
 
-	err = client.Query(context.Background(), &query, variables)
+	if len(entry.SignedBy) != 0 {
+		progress.printf("[Downloaded %s] %s (%s) signed by %s\n", pkg.Name, pkg.Tag, shortCommit(pkg.Commit), entry.SignedBy)
+	} else {
+		progress.printf("[Downloaded %s] %s (%s)\n", pkg.Name, pkg.Tag, shortCommit(pkg.Commit))
+	}
+	return entry, nil
+}
+
+// removeOldSource deletes a source tree a package has moved on from, as long as it is one we created in source/
+func removeOldSource(path string) {
+	sourceRoot, err := filepath.Abs("source")
 	if err != nil {
 		return
 	}
 
-	if len(query.Repository.Refs.Edges) < 1 {
-		err = fmt.Errorf("Unable to request tags")
+	if !strings.HasPrefix(path, sourceRoot+string(filepath.Separator)) || !directoryExists(path) {
 		return
 	}
 
-	if len(regex) == 0 {
-		tagName = path.Base(query.Repository.Refs.Edges[0].Node.Target.Tag.Name)
-		commitHash = path.Base(query.Repository.Refs.Edges[0].Node.Target.CommitResourcePath.Path)
-		return
+	fmt.Printf("Removing old source %s\n", path)
+	if err := os.RemoveAll(path); err != nil {
+		log.Printf("[WARN] Unable to remove old source %s: %s\n", path, err)
+	}
+}
+
+// newTagSource picks where tags for a package are looked up, a local mirror of the git repository or the github api
+// The graphql api needs a token, without one the rest api is used instead which works for public repositories
+func newTagSource(p Package) (tagSource, error) {
+	if p.SourceType == gitSource {
+		return openGitMirror(p.Repository, true)
 	}
 
-	reg, err := regexp.Compile(regex)
+	owner, name, err := githubRepository(p.Repository)
 	if err != nil {
-		return
+		return nil, err
+	}
+
+	if len(auth.token(hostOf(p.APIURL))) == 0 {
+		warnUnauthenticated(hostOf(p.APIURL))
+		return githubRESTTags{api: p.APIURL, owner: owner, name: name}, nil
 	}
 
-	//As the graphql library we're using cant do DESC without panicking like ffs
-	for i := len(query.Repository.Refs.Edges) - 1; i > 0; i-- {
-		v := query.Repository.Refs.Edges[i]
+	return githubTags{client: newGithubClient(p.GraphQLURL), owner: owner, name: name}, nil
+}
 
-		if reg.MatchString(v.Node.Target.Tag.Name) {
-			tagName = path.Base(v.Node.Target.Tag.Name)
-			commitHash = path.Base(v.Node.Target.CommitResourcePath.Path)
+// resolve works out which tag and commit the package should be built from
+func resolve(p Package) (tagName, commitHash string, err error) {
 
-			return
-		}
+	source, err := newTagSource(p)
+	if err != nil {
+		return "", "", err
 	}
 
-	err = fmt.Errorf("No matches found for regex: '%s'", regex)
-	return
+	if len(p.Version) != 0 {
+		return resolveVersion(source, p.Version, p.ValidTagRegex)
+	}
+
+	return getLatestPackage(source, p.ValidTagRegex)
 }
 
-func downloadFile(filepath string, url string) error {
+type fetchedSource struct {
+	lockedPackage
+	Path string // Absolute path to the downloaded archive or checkout
+}
 
-	resp, err := http.Head(url)
+// fetch downloads the package at its resolved tag and commit, and checks its signature if it has one
+func fetch(p Package) (fetched fetchedSource, err error) {
+	fetched, err = download(p)
 	if err != nil {
-		return err
+		return fetched, err
 	}
-	defer resp.Body.Close()
 
-	etag := resp.Header.Get("ETag") //This is for storing/retrieving etag values for caching purposes
+	return fetched, verifyFetched(p, &fetched)
+}
 
-	hash := sha1.Sum([]byte(url))
-	v := hex.EncodeToString(hash[:])
+func download(p Package) (fetched fetchedSource, err error) {
 
-	contents, err := ioutil.ReadFile("cache/" + v)
-	if err == nil && string(contents) == etag {
-		return nil
+	if p.SourceType == gitSource {
+		return checkoutGit(p, true)
 	}
 
-	resp, err = http.Get(url)
+	owner, name, err := githubRepository(p.Repository)
 	if err != nil {
-		return err
+		return
 	}
-	defer resp.Body.Close()
 
-	out, err := os.Create(filepath)
-	if err != nil {
-		return err
+	if len(p.ReleaseAsset) != 0 {
+		return fetchReleaseAsset(p, owner, name)
 	}
-	defer out.Close()
 
-	// Write the body to file
-	_, err = io.Copy(out, resp.Body)
+	outputFile := "./source/" + name + "-" + strings.ReplaceAll(p.Tag, "/", "_") + ".tar.gz"
+	archiveURL := fmt.Sprintf("%s/%s/%s/archive/%s.tar.gz", p.ArchiveHost, owner, name, p.Commit)
 
-	ioutil.WriteFile("cache/"+v, []byte(etag), 0600)
-
-	return err
-}
-
-func extractPackages(packages []*Package) (extractedSourcesPaths map[string]string, err error) {
-	if len(packages) == 0 {
-		return extractedSourcesPaths, fmt.Errorf("No archive paths defined for any packages....")
+	fetched.SHA256, err = downloadArchive(p, outputFile, archiveURL, "")
+	if err != nil {
+		return
 	}
 
-	type packageNameToExtractedSource struct {
-		Name string
-		Path string
+	fetched.Path, err = filepath.Abs(outputFile)
+	if err != nil {
+		return
 	}
 
-	extractedSourcesPaths = make(map[string]string)
-
-	newDirectories := make(chan packageNameToExtractedSource)
-	defer close(newDirectories)
-	errorsChannel := make(chan error)
-	for _, v := range packages {
+	fetched.Tag = p.Tag
+	fetched.Commit = p.Commit
+	fetched.URL = archiveURL
 
-		go func(pkg *Package) {
+	return
+}
 
-			if fsi, err := os.Stat(pkg.Source); err == nil && fsi.IsDir() {
-				newDirectories <- packageNameToExtractedSource{pkg.Name, pkg.Source}
-				return // Isnt a archive so dont extract
-			}
+// versionedSourceDirectory is where the extracted sources of a package live, named so that every tag and commit gets its own tree
+func versionedSourceDirectory(p Package) string {
+	name := p.Name + "-" + strings.ReplaceAll(p.Tag, "/", "_")
+	if len(p.Commit) != 0 {
+		name += "-" + shortCommit(p.Commit)
+	}
 
-			r, err := os.Open(pkg.Source)
-			if err != nil {
-				errorsChannel <- err
-				return
-			}
+	return filepath.Join("source", name)
+}
 
-			outputDirect, err := extractTarGz(r)
-			if err != nil {
-				errorsChannel <- err
-				return
-			}
+// replaceSourceDirectory moves a freshly extracted tree into place, replacing whatever was there
+// The old tree is renamed aside rather than removed first, so there is always a complete tree at destination
+func replaceSourceDirectory(extracted, destination string) (string, error) {
+	destination, err := filepath.Abs(destination)
+	if err != nil {
+		return "", err
+	}
 
-			pkg.Source = outputDirect
+	old := ""
+	if _, err := os.Lstat(destination); err == nil {
+		old, err = ioutil.TempDir(filepath.Dir(destination), "."+filepath.Base(destination)+"-old-")
+		if err != nil {
+			return "", err
+		}
 
-			newDirectories <- packageNameToExtractedSource{pkg.Name, pkg.Source}
-		}(v)
+		// TempDir only picks the name, os.Rename wont replace a directory
+		os.Remove(old)
+		if err := os.Rename(destination, old); err != nil {
+			return "", err
+		}
 	}
 
-	for i := 0; i < len(packages); i++ {
-		select {
-		case t := <-newDirectories:
-			extractedSourcesPaths[t.Name] = t.Path
-		case m := <-errorsChannel:
-			return extractedSourcesPaths, m
+	if err := os.Rename(extracted, destination); err != nil {
+		if len(old) != 0 {
+			os.Rename(old, destination)
 		}
+		return "", err
 	}
 
-	return extractedSourcesPaths, nil
+	if len(old) != 0 {
+		os.RemoveAll(old)
+	}
+
+	return destination, nil
 }
 
-func extractTarGz(gzipStream io.Reader) (outputDirectory string, err error) {
-	uncompressedStream, err := gzip.NewReader(gzipStream)
+// extractIntoPlace unpacks an archive into a temporary directory, then renames it to the packages versioned source directory
+func extractIntoPlace(ctx context.Context, pkg *Package) (string, error) {
+	temporary, err := ioutil.TempDir("source", "."+pkg.Name+"-extract-")
 	if err != nil {
-		return "", fmt.Errorf("ExtractTarGz: %s", err)
+		return "", err
 	}
+	defer os.RemoveAll(temporary)
 
-	tarReader := tar.NewReader(uncompressedStream)
-
-	firstDirectory := true
+	extracted, err := extractArchive(ctx, pkg.Source, temporary, pkg.StripComponents)
+	if err != nil {
+		return "", err
+	}
 
-	for true {
-		header, err := tarReader.Next()
+	err = writeStamp(extracted, pkg.stamp())
+	if err != nil {
+		return "", err
+	}
 
-		if err == io.EOF {
-			break
-		}
+	return replaceSourceDirectory(extracted, versionedSourceDirectory(*pkg))
+}
 
-		if err != nil {
-			return "", fmt.Errorf("ExtractTarGz: Next() failed: %s", err)
-		}
+// extractPackages unpacks every package whose source is still an archive, workers at a time. Every package is tried
+// and all the failures are reported together. Cancelling ctx stops the extractions in progress and starts no more,
+// either way nothing half extracted is left behind
+func extractPackages(ctx context.Context, packages []*Package, workers int) (extractedSourcesPaths map[string]string, err error) {
+	if len(packages) == 0 {
+		return extractedSourcesPaths, fmt.Errorf("No archive paths defined for any packages....")
+	}
 
-		path := "source/" + header.Name
-		switch header.Typeflag {
+	if workers < 1 {
+		workers = 1
+	}
 
-		case tar.TypeDir:
-			if firstDirectory {
-				firstDirectory = false
-				outputDirectory = path
-			}
+	// Each worker only touches its own packages slots, so nothing needs locking
+	errs := make([]error, len(packages))
+	done := make([]bool, len(packages))
+	work := make(chan int)
 
-			if fsinfo, err := os.Stat(path); err == nil && fsinfo.IsDir() {
-				continue
-			}
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
 
-			if err := os.Mkdir(path, fs.FileMode(header.Mode)); err != nil {
-				return "", fmt.Errorf("ExtractTarGz: Mkdir() failed: %s", err.Error())
-			}
+			for i := range work {
+				pkg := packages[i]
+				if directoryExists(pkg.Source) {
+					done[i] = true
+					continue // Isnt a archive so dont extract
+				}
 
-		case tar.TypeReg:
+				outputDirect, err := extractIntoPlace(ctx, pkg)
+				if err != nil {
+					errs[i] = fmt.Errorf("Package [%s]: %s", pkg.Name, err)
+					continue
+				}
 
-			outFile, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, fs.FileMode(header.Mode))
-			if err != nil {
-				return "", fmt.Errorf("ExtractTarGz: Create() failed: %s", err.Error())
+				pkg.Source = outputDirect
+				done[i] = true
 			}
-			if _, err := io.Copy(outFile, tarReader); err != nil {
-				return "", fmt.Errorf("ExtractTarGz: Copy() failed: %s", err.Error())
-			}
-			outFile.Close()
+		}()
+	}
 
-		default:
-			continue
+queue:
+	for i := range packages {
+		select {
+		case work <- i:
+		case <-ctx.Done():
+			break queue
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	// Whatever was extracted before a failure or cancelling is returned along with the error
+	extractedSourcesPaths = make(map[string]string)
+	for i, pkg := range packages {
+		if done[i] {
+			extractedSourcesPaths[pkg.Name] = pkg.Source
 		}
+	}
 
+	if ctx.Err() != nil {
+		return extractedSourcesPaths, fmt.Errorf("Extraction cancelled: %s", ctx.Err())
 	}
-	return outputDirectory, nil
+
+	return extractedSourcesPaths, errors.Join(errs...)
 }
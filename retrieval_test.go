@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReplaceSourceDirectory(t *testing.T) {
+	root := t.TempDir()
+	destination := filepath.Join(root, "pkg-v1.0")
+
+	for _, contents := range []string{"one", "two"} {
+		extracted, err := ioutil.TempDir(root, ".extract-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(extracted, "file"), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		path, err := replaceSourceDirectory(extracted, destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(path, "file")); err != nil || string(b) != contents {
+			t.Errorf("Replaced tree has %q %v, want %q", b, err, contents)
+		}
+	}
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("The old tree should have been removed, left %d entries", len(entries))
+	}
+}
+
+func TestExtractPackagesPartialFailure(t *testing.T) {
+	root := t.TempDir()
+	inDirectory(t, root)
+	if err := os.MkdirAll("source", 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTarball(t, filepath.Join(root, "good.tar.gz"), tarFile("good-1.0/README", "good"))
+	if err := ioutil.WriteFile(filepath.Join(root, "bad.tar.gz"), []byte("not an archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	packages := []*Package{
+		{Name: "bad", Tag: "v1.0", Source: filepath.Join(root, "bad.tar.gz")},
+		{Name: "good", Tag: "v1.0", Source: filepath.Join(root, "good.tar.gz")},
+	}
+
+	extracted, err := extractPackages(context.Background(), packages, 1)
+	if err == nil {
+		t.Errorf("Extracting something that isnt an archive should fail")
+	}
+	if _, ok := extracted["bad"]; ok {
+		t.Errorf("The package that failed shouldnt be returned")
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(extracted["good"], "README")); err != nil || string(b) != "good" {
+		t.Errorf("The package that was extracted should still be returned, got %q %v", b, err)
+	}
+}
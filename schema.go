@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// pkg.schema.json is generated from the pkg file types, run go generate after changing them. schema -check fails if it is out of date
+//go:generate go run . schema -o pkg.schema.json
+
+// Descriptions of every field, by the go type it is in and its json name. A field without one fails schema -check
+var schemaDescriptions = map[string]string{
+	"pkgManifest.$schema":           "Json schema of the pkg file, for editors. Not used otherwise",
+	"pkgManifest.include":           "Pkg files and directories of package definitions this one is merged over, relative to it. Later ones win over earlier ones",
+	"pkgManifest.replacements":      "Values substituted for $name$ in configure_opts, build, install, path, source_directory and mirror_directory",
+	"pkgManifest.oauth_token":       "Github token for github.com. Prefer GITHUB_TOKEN or -token-file, so the token isnt committed with the pkg file",
+	"pkgManifest.packages":          "Packages to fetch and build",
+	"pkgManifest.cross_compiler":    "Toolchain prefix substituted for $cross_compiler$ in configure_opts, build and install",
+	"pkgManifest.image_settings":    "How the squashfs image is made from the build directory",
+	"pkgManifest.keep_old_sources":  "Dont delete a packages previous source tree when it moves to a new version",
+	"pkgManifest.mirrors":           "Mirror urls tried for every package, after the packages own mirrors",
+	"pkgManifest.mirror_directory":  "Local directory of archives used by packages that dont set their own",
+	"pkgManifest.network":           "Timeouts and retries for every request",
+	"pkgManifest.credential_helper": "Command that prints the token for the host given as its argument, or \"git\" to use git credential fill",
+
+	"githubEndpoints.api_url":      "Github rest api, defaults to https://api.github.com or <archive_host>/api/v3",
+	"githubEndpoints.graphql_url":  "Github graphql api, defaults to https://api.github.com/graphql or <archive_host>/api/graphql",
+	"githubEndpoints.archive_host": "Where archives are downloaded from, defaults to the scheme and host of repo",
+
+	"Package.name":             "Name of the package, used by depends and for its directories",
+	"Package.repo":             "Github repository (owner/name or its url), or for git sources any url git understands",
+	"Package.source_type":      "\"github\" downloads archives, \"git\" clones, \"path\" uses a local directory. Defaults to path if path is set, otherwise github",
+	"Package.path":             "Local directory for path sources",
+	"Package.path_mode":        "\"reference\" builds the directory in place, \"copy\" builds a copy of it in source/",
+	"Package.tag_regex":        "Only tags matching this regex are considered",
+	"Package.version":          "Exact tag, branch, commit or a constraint like \">=1.2.11 <1.3\". Defaults to the newest tag",
+	"Package.release_asset":    "Download the release asset matching this pattern instead of the generated archive",
+	"Package.strip_components": "Leading path components removed from every archive entry, like tar --strip-components",
+	"Package.mirrors":          "Mirror urls tried in order before upstream, before the global mirrors",
+	"Package.mirror_directory": "Local directory of archives, laid out like a vendor directory. Replaces the global one",
+	"Package.source_directory": "Older name for path",
+	"Package.configure_opts":   "Command run in the source directory to configure the package",
+	"Package.depends":          "Packages that have to be built before this one",
+	"Package.install":          "Command run after building to install the package",
+	"Package.build":            "Command run to build the package, defaults to make",
+	"Package.patches":          "Directory of .patch files applied after configuring, subdirectories named after a version constraint only apply to matching tags",
+	"Package.patch_sets":       "Tag regex -> directory of patches applied when the tag matches",
+	"Package.signature":        "Keys downloads of the package have to be signed with",
+
+	"Image.image_name":              "File name of the squashfs image",
+	"Image.cross_compiler_lib_root": "Toolchain sysroot lib directory, searched for libraries the executables need",
+	"Image.executables":             "Executables (globs, relative to build/) to put in the image along with their libraries",
+	"Image.ld_library_paths":        "Extra directories searched for libraries",
+	"Image.image_config":            "Directory copied over the image, for init.sh, postup.sh and configuration",
+
+	"networkSettings.timeout":     "Connecting and waiting for a response, and the whole of an api request",
+	"networkSettings.retries":     "How many times a failed request is tried again",
+	"networkSettings.backoff":     "Wait before the first retry, doubled for every one after",
+	"networkSettings.max_backoff": "Longest wait between retries",
+	"networkSettings.max_wait":    "Longest to wait for a rate limit to reset before giving up",
+
+	"signatureSettings.type": "How the package is signed",
+	"signatureSettings.keys": "Public key files kept in the repository, the signature has to be made by one of them",
+	"signatureSettings.url":  "Detached signature, relative to the archive url unless absolute, with the same placeholders as mirrors. Defaults to the archive name with .asc, .sig or .minisig",
+}
+
+// Fields that only take certain values
+var schemaEnums = map[string][]string{
+	"Package.source_type":    {githubSource, gitSource, pathSource},
+	"Package.path_mode":      {referencePath, copyPath},
+	"signatureSettings.type": {gitTagSignature, openPGPSignature, signifySignature, minisignSignature},
+}
+
+var schemaRequired = map[string][]string{
+	"pkgManifest":       {"packages"},
+	"Package":           {"name"},
+	"signatureSettings": {"type", "keys"},
+}
+
+// Durations are strings like "30s" or "2m"
+var schemaDurationPattern = `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`
+
+// Types that get their own definition, rather than being written out everywhere they are used
+var schemaDefinitions = map[reflect.Type]string{
+	reflect.TypeOf(Package{}):           "package",
+	reflect.TypeOf(Image{}):             "image",
+	reflect.TypeOf(networkSettings{}):   "network",
+	reflect.TypeOf(signatureSettings{}): "signature",
+}
+
+type schemaGenerator struct {
+	definitions map[string]interface{}
+	missing     []string // Fields without a description
+}
+
+// generateSchema builds the json schema of the pkg file from its types
+func generateSchema() (schema map[string]interface{}, missing []string) {
+	g := schemaGenerator{definitions: make(map[string]interface{})}
+
+	schema = g.object(reflect.TypeOf(pkgManifest{}))
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "Package manager pkg file"
+	schema["definitions"] = g.definitions
+
+	sort.Strings(g.missing)
+	return schema, g.missing
+}
+
+func (g *schemaGenerator) object(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	g.properties(t, t.Name(), properties)
+
+	schema := map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+
+	if required, ok := schemaRequired[t.Name()]; ok {
+		schema["required"] = required
+	}
+
+	return schema
+}
+
+func (g *schemaGenerator) properties(t reflect.Type, owner string, properties map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		if f.Anonymous && f.Type.Kind() == reflect.Struct && len(tag) == 0 {
+			g.properties(f.Type, f.Type.Name(), properties)
+			continue
+		}
+
+		if !f.IsExported() {
+			continue
+		}
+
+		name := strings.Split(tag, ",")[0]
+		if len(name) == 0 {
+			name = strings.ToLower(f.Name)
+		}
+
+		key := owner + "." + name
+		property := g.value(f.Type)
+
+		if description, ok := schemaDescriptions[key]; ok {
+			property["description"] = description
+		} else {
+			g.missing = append(g.missing, key)
+		}
+
+		if enum, ok := schemaEnums[key]; ok {
+			property["enum"] = enum
+		}
+
+		if owner == "networkSettings" && f.Type.Kind() == reflect.String {
+			property["pattern"] = schemaDurationPattern
+		}
+
+		properties[name] = property
+	}
+}
+
+func (g *schemaGenerator) value(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": g.value(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.value(t.Elem())}
+	case reflect.Struct:
+		name, ok := schemaDefinitions[t]
+		if !ok {
+			return g.object(t)
+		}
+
+		if _, done := g.definitions[name]; !done {
+			g.definitions[name] = nil // Stops a type that contains itself from recursing forever
+			g.definitions[name] = g.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/definitions/" + name}
+	}
+
+	return map[string]interface{}{}
+}
+
+func marshalSchema() ([]byte, []string, error) {
+	schema, missing := generateSchema()
+
+	// Without escaping, so descriptions keep their <placeholders> readable
+	b := bytes.Buffer{}
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "\t")
+
+	if err := encoder.Encode(schema); err != nil {
+		return nil, nil, err
+	}
+
+	return b.Bytes(), missing, nil
+}
+
+// schema prints the json schema of the pkg file, writes it with -o, or with -check makes sure a file of it is up to date
+func schema(args []string) error {
+	flags := flag.NewFlagSet("schema", flag.ExitOnError)
+	output := flags.String("o", "", "Write the schema to this file rather than printing it")
+	checkFile := flags.String("check", "", "Fail if this file isnt the current schema, or a field has no description")
+	flags.Parse(args)
+
+	b, missing, err := marshalSchema()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(*checkFile) != 0:
+		if len(missing) != 0 {
+			return fmt.Errorf("Fields without a description in schemaDescriptions: %s", strings.Join(missing, ", "))
+		}
+
+		existing, err := ioutil.ReadFile(*checkFile)
+		if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(existing, b) {
+			return fmt.Errorf("%s is out of date, run go generate", *checkFile)
+		}
+
+		fmt.Printf("%s is up to date\n", *checkFile)
+		return nil
+
+	case len(*output) != 0:
+		return ioutil.WriteFile(*output, b, 0644)
+	}
+
+	_, err = os.Stdout.Write(b)
+	return err
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+// pkg.schema.json has to match the go types, run go generate after changing them
+func TestSchemaUpToDate(t *testing.T) {
+	b, missing, err := marshalSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(missing) != 0 {
+		t.Errorf("Fields without a description in schemaDescriptions: %v", missing)
+	}
+
+	existing, err := ioutil.ReadFile("pkg.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(existing, b) {
+		t.Errorf("pkg.schema.json is out of date, run go generate")
+	}
+}
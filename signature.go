@@ -0,0 +1,541 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	gitTagSignature   = "git_tag"
+	openPGPSignature  = "openpgp"
+	signifySignature  = "signify"
+	minisignSignature = "minisign"
+)
+
+// signatureSettings is a packages "signature" block, when set every download of the package has to be signed by one of the keys
+type signatureSettings struct {
+	Type string   `json:"type"` // "git_tag", "openpgp", "signify" or "minisign"
+	Keys []string `json:"keys"` // Public keys kept in the repository, the signature has to be made by one of them
+	URL  string   `json:"url"`  // Detached signature, relative to the archive url unless absolute, with the same placeholders as mirrors
+}
+
+// Where the detached signature is expected if the package doesnt say
+var defaultSignatureURLs = map[string]string{
+	openPGPSignature:  "{file}.asc",
+	signifySignature:  "{file}.sig",
+	minisignSignature: "{file}.minisig",
+}
+
+func (s signatureSettings) enabled() bool {
+	return len(s.Type) != 0
+}
+
+// check makes sure the signature block makes sense for the packages source type, and that its keys exist
+func (s signatureSettings) check(sourceType string) error {
+	if !s.enabled() {
+		if len(s.Keys) != 0 || len(s.URL) != 0 {
+			return fmt.Errorf("signature has no type")
+		}
+		return nil
+	}
+
+	switch s.Type {
+	case gitTagSignature:
+		if len(s.URL) != 0 {
+			return fmt.Errorf("signature url isnt used for git_tag signatures")
+		}
+	case openPGPSignature, signifySignature, minisignSignature:
+		if sourceType == gitSource {
+			return fmt.Errorf("git sources can only be verified with git_tag signatures")
+		}
+		if err := checkMirror(s.URL); err != nil {
+			return fmt.Errorf("signature url: %s", err)
+		}
+	default:
+		return fmt.Errorf("signature has an unknown type '%s'", s.Type)
+	}
+
+	if sourceType == pathSource {
+		return fmt.Errorf("path sources cant be verified")
+	}
+
+	if len(s.Keys) == 0 {
+		return fmt.Errorf("signature needs at least one key")
+	}
+
+	for _, key := range s.Keys {
+		if _, err := os.Stat(key); err != nil {
+			return fmt.Errorf("signature key %s", err)
+		}
+	}
+
+	return nil
+}
+
+// verifyFetched checks the signature of something that was just fetched, recording who signed it
+// A fetch that fails verification is deleted, along with its copy in the download cache, so it cant be picked up later
+func verifyFetched(p Package, fetched *fetchedSource) error {
+	if !p.Signature.enabled() {
+		return nil
+	}
+
+	signer, err := verifySignature(p, *fetched)
+	if err != nil {
+		os.RemoveAll(fetched.Path)
+		if len(fetched.SHA256) != 0 {
+			os.Remove(objectPath(fetched.SHA256))
+		}
+		return fmt.Errorf("Signature verification failed: %s", err)
+	}
+
+	fetched.SignedBy = signer
+	return nil
+}
+
+func verifySignature(p Package, fetched fetchedSource) (signer string, err error) {
+	if p.Signature.Type == gitTagSignature {
+		payload, signature, err := tagObject(p)
+		if err != nil {
+			return "", err
+		}
+
+		if err := checkTagPayload(payload, p.Tag, p.Commit); err != nil {
+			return "", err
+		}
+
+		return verifyOpenPGP(p.Signature.Keys, signature, payload)
+	}
+
+	signatureURL, err := detachedSignatureURL(p, fetched.URL)
+	if err != nil {
+		return "", err
+	}
+
+	temporary, err := ioutil.TempFile("source", ".signature-")
+	if err != nil {
+		return "", err
+	}
+	temporary.Close()
+	defer os.Remove(temporary.Name())
+
+	if _, err := downloadFile(temporary.Name(), signatureURL, nil); err != nil {
+		return "", fmt.Errorf("Unable to get the signature: %s", err)
+	}
+
+	signature, err := ioutil.ReadFile(temporary.Name())
+	if err != nil {
+		return "", err
+	}
+
+	switch p.Signature.Type {
+	case openPGPSignature:
+		data, err := ioutil.ReadFile(fetched.Path)
+		if err != nil {
+			return "", err
+		}
+		return verifyOpenPGP(p.Signature.Keys, signature, data)
+	case signifySignature:
+		return verifySignify(p.Signature.Keys, signature, fetched.Path)
+	default:
+		return verifyMinisign(p.Signature.Keys, signature, fetched.Path)
+	}
+}
+
+// detachedSignatureURL fills in the packages signature url, resolving it against the url the archive came from
+func detachedSignatureURL(p Package, upstream string) (string, error) {
+	template := p.Signature.URL
+	if len(template) == 0 {
+		template = defaultSignatureURLs[p.Signature.Type]
+	}
+
+	expanded, ok := expandPlaceholders(template, mirrorVariables(p, upstream))
+	if !ok {
+		return "", fmt.Errorf("Signature url '%s' cant be filled in for %s", template, upstream)
+	}
+
+	base, err := url.Parse(upstream)
+	if err != nil {
+		return "", err
+	}
+
+	relative, err := url.Parse(expanded)
+	if err != nil {
+		return "", err
+	}
+
+	return base.ResolveReference(relative).String(), nil
+}
+
+// tagObject gets the raw tag object of the packages tag, split into the signed part and its openpgp signature
+func tagObject(p Package) (payload, signature []byte, err error) {
+	if p.SourceType != gitSource {
+		payload, signature, err := githubTagObject(p)
+		return []byte(payload), []byte(signature), err
+	}
+
+	// The mirror is already up to date, it was just checked out from
+	m, err := openGitMirror(p.Repository, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if kind, err := git(m.path, "cat-file", "-t", "refs/tags/"+p.Tag); err != nil || strings.TrimSpace(string(kind)) != "tag" {
+		return nil, nil, fmt.Errorf("%s isnt an annotated tag, so it cant be signed", p.Tag)
+	}
+
+	raw, err := git(m.path, "cat-file", "tag", "refs/tags/"+p.Tag)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, marker := range []string{"-----BEGIN PGP SIGNATURE-----", "-----BEGIN SSH SIGNATURE-----"} {
+		if i := bytes.Index(raw, []byte(marker)); i != -1 {
+			return raw[:i], raw[i:], nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("Tag %s isnt signed", p.Tag)
+}
+
+// githubTagObject asks the github api for the tag object, which comes with its signature split out
+func githubTagObject(p Package) (payload, signature string, err error) {
+	owner, name, err := githubRepository(p.Repository)
+	if err != nil {
+		return "", "", err
+	}
+	g := githubRESTTags{api: p.APIURL, owner: owner, name: name}
+
+	var ref struct {
+		Object struct {
+			Type string `json:"type"`
+			Sha  string `json:"sha"`
+		} `json:"object"`
+	}
+	if err := g.getJSON(g.url("git/ref/tags/"+p.Tag), &ref); err != nil {
+		return "", "", err
+	}
+
+	if ref.Object.Type != "tag" {
+		return "", "", fmt.Errorf("%s isnt an annotated tag, so it cant be signed", p.Tag)
+	}
+
+	var tag struct {
+		Verification struct {
+			Signature *string `json:"signature"`
+			Payload   *string `json:"payload"`
+		} `json:"verification"`
+	}
+	if err := g.getJSON(g.url("git/tags/"+ref.Object.Sha), &tag); err != nil {
+		return "", "", err
+	}
+
+	if tag.Verification.Signature == nil || tag.Verification.Payload == nil {
+		return "", "", fmt.Errorf("Tag %s isnt signed", p.Tag)
+	}
+
+	return *tag.Verification.Payload, *tag.Verification.Signature, nil
+}
+
+func (g githubRESTTags) getJSON(u string, v interface{}) error {
+	resp, err := g.get(u, "application/vnd.github+json")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return githubError(fmt.Errorf("Getting %s failed: %s", u, resp.Status))
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// checkTagPayload makes sure a signed tag is the tag we asked for, and points at the commit we are going to build
+// Otherwise a validly signed tag could be moved onto some other commit, or renamed
+func checkTagPayload(payload []byte, tag, commit string) error {
+	headers := make(map[string]string)
+
+	scanner := bufio.NewScanner(bytes.NewReader(payload))
+	for scanner.Scan() && len(scanner.Text()) != 0 {
+		if fields := strings.SplitN(scanner.Text(), " ", 2); len(fields) == 2 {
+			headers[fields[0]] = fields[1]
+		}
+	}
+
+	if headers["tag"] != tag {
+		return fmt.Errorf("Signed tag is named '%s' not '%s'", headers["tag"], tag)
+	}
+
+	if headers["type"] != "commit" || !strings.EqualFold(headers["object"], commit) {
+		return fmt.Errorf("Signed tag %s points at %s %s, not commit %s", tag, headers["type"], headers["object"], commit)
+	}
+
+	return nil
+}
+
+// verifyOpenPGP checks a detached signature with gpg, using a keyring of just the pinned keys
+// Returns the fingerprint of the key that signed it
+func verifyOpenPGP(keys []string, signature, data []byte) (string, error) {
+	if bytes.HasPrefix(signature, []byte("-----BEGIN SSH SIGNATURE-----")) {
+		return "", fmt.Errorf("Only openpgp signatures are supported, this is signed with ssh")
+	}
+
+	if _, err := exec.LookPath("gpg"); err != nil {
+		return "", fmt.Errorf("gpg is needed to check openpgp signatures: %s", err)
+	}
+
+	home, err := ioutil.TempDir("", "pm-gnupg-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(home)
+
+	signatureFile := filepath.Join(home, "signature")
+	dataFile := filepath.Join(home, "data")
+	if err := ioutil.WriteFile(signatureFile, signature, 0600); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(dataFile, data, 0600); err != nil {
+		return "", err
+	}
+
+	if _, err := gpg(home, append([]string{"--import"}, keys...)...); err != nil {
+		return "", err
+	}
+
+	// Trust doesnt matter, the keyring only holds keys we trust
+	status, err := gpg(home, "--status-fd", "1", "--trust-model", "always", "--verify", signatureFile, dataFile)
+	if err != nil {
+		return "", fmt.Errorf("Bad or unknown signature, %s", err)
+	}
+
+	for _, line := range strings.Split(string(status), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 2 && fields[0] == "[GNUPG:]" && fields[1] == "VALIDSIG" {
+			return openPGPSignature + " " + fields[2], nil
+		}
+	}
+
+	return "", fmt.Errorf("gpg didnt report a valid signature")
+}
+
+func gpg(home string, args ...string) ([]byte, error) {
+	cmd := exec.Command("gpg", append([]string{"--homedir", home, "--batch", "--no-tty", "--quiet"}, args...)...)
+	stderr := bytes.Buffer{}
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		return output, fmt.Errorf("gpg failed: %s %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+// openPGPFingerprints lists the fingerprints of the keys in the key files, subkeys included, as any of them can sign
+func openPGPFingerprints(keys []string) ([]string, error) {
+	home, err := ioutil.TempDir("", "pm-gnupg-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(home)
+
+	output, err := gpg(home, append([]string{"--with-colons", "--import-options", "show-only", "--import"}, keys...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprints := []string{}
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) > 9 && fields[0] == "fpr" {
+			fingerprints = append(fingerprints, fields[9])
+		}
+	}
+
+	return fingerprints, nil
+}
+
+// signedByCurrentKey is whether a lock file entrys SignedBy is one of the packages keys as they are now, so removing
+// or replacing a key makes whatever it signed unverified again
+func (s signatureSettings) signedByCurrentKey(signedBy string) bool {
+	kind, id, found := strings.Cut(signedBy, " ")
+	if !found || len(s.Keys) == 0 {
+		return false
+	}
+
+	switch s.Type {
+	case gitTagSignature, openPGPSignature:
+		if kind != openPGPSignature {
+			return false
+		}
+
+		fingerprints, err := openPGPFingerprints(s.Keys)
+		if err != nil {
+			return false
+		}
+		for _, fingerprint := range fingerprints {
+			if strings.EqualFold(fingerprint, id) {
+				return true
+			}
+		}
+	case signifySignature, minisignSignature:
+		if kind != s.Type {
+			return false
+		}
+
+		for _, path := range s.Keys {
+			contents, err := ioutil.ReadFile(path)
+			if err != nil {
+				continue
+			}
+			key, _, err := readSignifyFile(contents, ed25519.PublicKeySize)
+			if err == nil && key.algorithm == "Ed" && keyID(key.keyNumber) == id {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// signifyBlob is the decoded base64 line of a signify or minisign key or signature: an algorithm, a key number and the key or signature
+type signifyBlob struct {
+	algorithm string
+	keyNumber []byte
+	data      []byte
+}
+
+// readSignifyFile decodes the files "untrusted comment:" line and the base64 line after it, then any lines after those
+func readSignifyFile(contents []byte, dataSize int) (blob signifyBlob, rest []string, err error) {
+	lines := strings.Split(strings.TrimRight(strings.ReplaceAll(string(contents), "\r\n", "\n"), "\n"), "\n")
+	if len(lines) < 2 || !strings.HasPrefix(lines[0], "untrusted comment:") {
+		return blob, nil, fmt.Errorf("Isnt a signify or minisign file")
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(decoded) != 2+8+dataSize {
+		return blob, nil, fmt.Errorf("Isnt a signify or minisign file")
+	}
+
+	return signifyBlob{algorithm: string(decoded[:2]), keyNumber: decoded[2:10], data: decoded[10:]}, lines[2:], nil
+}
+
+// findEd25519Key finds the pinned key with the key number a signature was made with
+func findEd25519Key(keys []string, keyNumber []byte) (ed25519.PublicKey, error) {
+	for _, path := range keys {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		key, _, err := readSignifyFile(contents, ed25519.PublicKeySize)
+		if err != nil {
+			return nil, fmt.Errorf("Key %s: %s", path, err)
+		}
+
+		if key.algorithm == "Ed" && bytes.Equal(key.keyNumber, keyNumber) {
+			return ed25519.PublicKey(key.data), nil
+		}
+	}
+
+	return nil, fmt.Errorf("Signed with key %s, which isnt one of the pinned keys", keyID(keyNumber))
+}
+
+// keyID formats a key number the way minisign shows it
+func keyID(keyNumber []byte) string {
+	return fmt.Sprintf("%016X", binary.LittleEndian.Uint64(keyNumber))
+}
+
+func verifySignify(keys []string, signature []byte, path string) (string, error) {
+	sig, _, err := readSignifyFile(signature, ed25519.SignatureSize)
+	if err != nil {
+		return "", err
+	}
+
+	if sig.algorithm != "Ed" {
+		return "", fmt.Errorf("Unknown signify algorithm '%s'", sig.algorithm)
+	}
+
+	key, err := findEd25519Key(keys, sig.keyNumber)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	if !ed25519.Verify(key, data, sig.data) {
+		return "", fmt.Errorf("Bad signature from key %s", keyID(sig.keyNumber))
+	}
+
+	return signifySignature + " " + keyID(sig.keyNumber), nil
+}
+
+// verifyMinisign checks both the signature of the file and the signature of the trusted comment. Prehashed ("ED") signatures
+// are of the files blake2b-512 hash, legacy ("Ed") ones of the file itself
+func verifyMinisign(keys []string, signature []byte, path string) (string, error) {
+	sig, rest, err := readSignifyFile(signature, ed25519.SignatureSize)
+	if err != nil {
+		return "", err
+	}
+
+	if len(rest) < 2 || !strings.HasPrefix(rest[0], "trusted comment: ") {
+		return "", fmt.Errorf("Minisign signature has no trusted comment")
+	}
+
+	key, err := findEd25519Key(keys, sig.keyNumber)
+	if err != nil {
+		return "", err
+	}
+
+	var message []byte
+	switch sig.algorithm {
+	case "ED":
+		f, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+
+		h, _ := blake2b.New512(nil)
+		if _, err := io.Copy(h, f); err != nil {
+			return "", err
+		}
+		message = h.Sum(nil)
+	case "Ed":
+		message, err = ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("Unknown minisign algorithm '%s'", sig.algorithm)
+	}
+
+	if !ed25519.Verify(key, message, sig.data) {
+		return "", fmt.Errorf("Bad signature from key %s", keyID(sig.keyNumber))
+	}
+
+	global, err := base64.StdEncoding.DecodeString(strings.TrimSpace(rest[1]))
+	if err != nil || !ed25519.Verify(key, append(append([]byte{}, sig.data...), strings.TrimPrefix(rest[0], "trusted comment: ")...), global) {
+		return "", fmt.Errorf("Bad trusted comment signature from key %s", keyID(sig.keyNumber))
+	}
+
+	return minisignSignature + " " + keyID(sig.keyNumber), nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// ed25519Key is a signify/minisign key pair, with its public key written to a file like one kept next to a pkg file
+type ed25519Key struct {
+	keyNumber []byte
+	private   ed25519.PrivateKey
+	path      string
+}
+
+func newEd25519Key(t *testing.T, dir, name string) ed25519Key {
+	t.Helper()
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k := ed25519Key{keyNumber: make([]byte, 8), private: private, path: filepath.Join(dir, name+".pub")}
+	rand.Read(k.keyNumber)
+
+	contents := "untrusted comment: " + name + " public key\n" + k.encode("Ed", public) + "\n"
+	if err := ioutil.WriteFile(k.path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return k
+}
+
+func (k ed25519Key) encode(algorithm string, data []byte) string {
+	return base64.StdEncoding.EncodeToString(append(append([]byte(algorithm), k.keyNumber...), data...))
+}
+
+func (k ed25519Key) signify(data []byte) []byte {
+	return []byte("untrusted comment: verify with key.pub\n" + k.encode("Ed", ed25519.Sign(k.private, data)) + "\n")
+}
+
+// minisign signs the blake2b hash of data (prehashed) or data itself (legacy), then the signature with the trusted comment
+func (k ed25519Key) minisign(data []byte, prehashed bool, comment string) []byte {
+	algorithm, message := "Ed", data
+	if prehashed {
+		sum := blake2b.Sum512(data)
+		algorithm, message = "ED", sum[:]
+	}
+
+	signature := ed25519.Sign(k.private, message)
+	global := ed25519.Sign(k.private, append(append([]byte{}, signature...), comment...))
+
+	return []byte("untrusted comment: signature from minisign secret key\n" + k.encode(algorithm, signature) + "\n" +
+		"trusted comment: " + comment + "\n" + base64.StdEncoding.EncodeToString(global) + "\n")
+}
+
+func TestSignifyAndMinisign(t *testing.T) {
+	dir := t.TempDir()
+	key := newEd25519Key(t, dir, "release")
+	other := newEd25519Key(t, dir, "other")
+
+	data := []byte("archive contents")
+	archive := filepath.Join(dir, "archive.tar.gz")
+	if err := ioutil.WriteFile(archive, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte("not the "), data...)
+
+	goodMinisign := key.minisign(data, true, "timestamp:1 file:archive.tar.gz")
+	lines := strings.Split(string(goodMinisign), "\n")
+	lines[2] = "trusted comment: timestamp:2 file:archive.tar.gz"
+	forgedComment := []byte(strings.Join(lines, "\n"))
+
+	tests := []struct {
+		name      string
+		verify    func(keys []string, signature []byte, path string) (string, error)
+		signature []byte
+		err       string // Part of the error, empty if it should verify
+	}{
+		{"signify", verifySignify, key.signify(data), ""},
+		{"signify tampered", verifySignify, key.signify(tampered), "Bad signature"},
+		{"signify other key", verifySignify, other.signify(data), "isnt one of the pinned keys"},
+		{"signify garbage", verifySignify, []byte("-----BEGIN PGP SIGNATURE-----\n"), "Isnt a signify or minisign file"},
+		{"minisign prehashed", verifyMinisign, goodMinisign, ""},
+		{"minisign legacy", verifyMinisign, key.minisign(data, false, "legacy"), ""},
+		{"minisign tampered", verifyMinisign, key.minisign(tampered, true, "tampered"), "Bad signature"},
+		{"minisign other key", verifyMinisign, other.minisign(data, true, "other"), "isnt one of the pinned keys"},
+		{"minisign forged trusted comment", verifyMinisign, forgedComment, "Bad trusted comment"},
+		{"minisign without trusted comment", verifyMinisign, key.signify(data), "no trusted comment"},
+	}
+
+	for _, test := range tests {
+		signer, err := test.verify([]string{key.path}, test.signature, archive)
+		switch {
+		case len(test.err) == 0 && err != nil:
+			t.Errorf("%s: %s", test.name, err)
+		case len(test.err) == 0 && !strings.HasSuffix(signer, " "+keyID(key.keyNumber)):
+			t.Errorf("%s: signed by %q, want key %s", test.name, signer, keyID(key.keyNumber))
+		case len(test.err) != 0 && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: should fail with %q, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestOpenPGP(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg isnt installed")
+	}
+
+	dir := t.TempDir()
+	data := []byte("signed tag payload")
+
+	// newKey makes a signing key in its own keyring, returning the exported public key and a function that signs with it
+	newKey := func(name string) (path string, sign func([]byte) []byte) {
+		home := filepath.Join(dir, name)
+		if err := os.Mkdir(home, 0700); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { exec.Command("gpgconf", "--homedir", home, "--kill", "gpg-agent").Run() })
+
+		if _, err := gpg(home, "--passphrase", "", "--quick-gen-key", name+" <"+name+"@example.com>", "ed25519", "sign", "never"); err != nil {
+			t.Skipf("Cant make a gpg key: %s", err)
+		}
+
+		public, err := gpg(home, "--armor", "--export")
+		if err != nil {
+			t.Fatal(err)
+		}
+		path = filepath.Join(dir, name+".asc")
+		if err := ioutil.WriteFile(path, public, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		return path, func(message []byte) []byte {
+			file := filepath.Join(home, "message")
+			if err := ioutil.WriteFile(file, message, 0600); err != nil {
+				t.Fatal(err)
+			}
+			signature, err := gpg(home, "--armor", "--output", "-", "--detach-sign", file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return signature
+		}
+	}
+
+	key, sign := newKey("release")
+	other, signOther := newKey("other")
+
+	fingerprints, err := openPGPFingerprints([]string{key})
+	if err != nil || len(fingerprints) == 0 {
+		t.Fatalf("Fingerprints of %s: %v %v", key, fingerprints, err)
+	}
+
+	tests := []struct {
+		name      string
+		signature []byte
+		err       string
+	}{
+		{"good", sign(data), ""},
+		{"tampered", sign(append([]byte("not the "), data...)), "Bad or unknown signature"},
+		{"other key", signOther(data), "Bad or unknown signature"},
+		{"ssh", []byte("-----BEGIN SSH SIGNATURE-----\n"), "signed with ssh"},
+	}
+
+	for _, test := range tests {
+		signer, err := verifyOpenPGP([]string{key}, test.signature, data)
+		switch {
+		case len(test.err) == 0 && err != nil:
+			t.Errorf("%s: %s", test.name, err)
+		case len(test.err) == 0 && signer != openPGPSignature+" "+fingerprints[0]:
+			t.Errorf("%s: signed by %q, want %s", test.name, signer, fingerprints[0])
+		case len(test.err) != 0 && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: should fail with %q, got %v", test.name, test.err, err)
+		}
+	}
+
+	// A lock file entry only stays verified while the key that signed it is still one of the packages keys
+	signedBy := openPGPSignature + " " + fingerprints[0]
+	current := []struct {
+		settings signatureSettings
+		signedBy string
+		want     bool
+	}{
+		{signatureSettings{Type: openPGPSignature, Keys: []string{key}}, signedBy, true},
+		{signatureSettings{Type: gitTagSignature, Keys: []string{other, key}}, strings.ToLower(signedBy), true},
+		{signatureSettings{Type: openPGPSignature, Keys: []string{other}}, signedBy, false},
+		{signatureSettings{Type: openPGPSignature, Keys: []string{key}}, "", false},
+		{signatureSettings{Type: openPGPSignature, Keys: []string{key}}, signifySignature + " " + fingerprints[0], false},
+	}
+
+	for _, test := range current {
+		if got := test.settings.signedByCurrentKey(test.signedBy); got != test.want {
+			t.Errorf("signedByCurrentKey(%q) with keys %v = %v, want %v", test.signedBy, test.settings.Keys, got, test.want)
+		}
+	}
+}
+
+func TestSignedByCurrentEd25519Key(t *testing.T) {
+	dir := t.TempDir()
+	key := newEd25519Key(t, dir, "release")
+	other := newEd25519Key(t, dir, "other")
+
+	tests := []struct {
+		settings signatureSettings
+		signedBy string
+		want     bool
+	}{
+		{signatureSettings{Type: signifySignature, Keys: []string{key.path}}, "signify " + keyID(key.keyNumber), true},
+		{signatureSettings{Type: minisignSignature, Keys: []string{other.path, key.path}}, "minisign " + keyID(key.keyNumber), true},
+		{signatureSettings{Type: minisignSignature, Keys: []string{other.path}}, "minisign " + keyID(key.keyNumber), false},
+		{signatureSettings{Type: minisignSignature, Keys: []string{key.path}}, "signify " + keyID(key.keyNumber), false},
+		{signatureSettings{Type: signifySignature, Keys: []string{key.path}}, keyID(key.keyNumber), false},
+		{signatureSettings{Type: signifySignature, Keys: []string{filepath.Join(dir, "missing.pub")}}, "signify " + keyID(key.keyNumber), false},
+	}
+
+	for _, test := range tests {
+		if got := test.settings.signedByCurrentKey(test.signedBy); got != test.want {
+			t.Errorf("signedByCurrentKey(%q) with keys %v = %v, want %v", test.signedBy, test.settings.Keys, got, test.want)
+		}
+	}
+}
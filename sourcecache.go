@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// extractionStamp is written into a source tree once it has been completely extracted, checked out or copied
+const extractionStamp = ".pm-extracted"
+
+// cachedSource is what we remember about a package between runs, so it doesnt need to be downloaded again
+type cachedSource struct {
+	Source      string `json:"source"`
+	Archive     string `json:"archive,omitempty"` // What Source was extracted from
+	SHA256      string `json:"sha256,omitempty"`  // Of the archive
+	Stamp       string `json:"stamp,omitempty"`   // Written into Source once it is completely extracted
+	Tag         string `json:"tag"`
+	Commit      string `json:"commit"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+func loadSourceCache() (map[string]cachedSource, error) {
+	cachedPackageSources := make(map[string]cachedSource)
+
+	source, err := ioutil.ReadFile(sourceCacheFile)
+	if err != nil {
+		return cachedPackageSources, nil
+	}
+
+	err = json.Unmarshal(source, &cachedPackageSources)
+	if err != nil {
+		// Older caches only recorded the source path, without the tag we cant pick patch sets so start again
+		var oldCache map[string]string
+		if json.Unmarshal(source, &oldCache) == nil {
+			fmt.Printf("Cache is from an older version and has no tags recorded, ignoring it\n")
+			return make(map[string]cachedSource), nil
+		}
+		return nil, err
+	}
+
+	return cachedPackageSources, nil
+}
+
+func writeSourceCache(cachedPackageSources map[string]cachedSource) error {
+	b, err := json.Marshal(cachedPackageSources)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(sourceCacheFile, b, 0600)
+}
+
+// sourceAction is what has to be done to get a cached source back into a usable state
+type sourceAction int
+
+const (
+	useCached sourceAction = iota // The tree is there and completely extracted
+	reextract                     // The tree is missing or incomplete (or -fresh was given), but the archive is intact
+	refetch                       // Neither the tree nor the archive can be used
+)
+
+// check works out what to do about a cached source. Hashing the archive is slow, so it is only done when the tree cant
+// be used as it is
+func (c cachedSource) check(fresh bool) sourceAction {
+	if !fresh && directoryExists(c.Source) {
+		// Caches written before stamps existed are trusted as long as the directory is there
+		if len(c.Stamp) == 0 || readStamp(c.Source) == c.Stamp {
+			return useCached
+		}
+	}
+
+	if len(c.Archive) != 0 && len(c.SHA256) != 0 {
+		if sum, err := fileSHA256(c.Archive); err == nil && sum == c.SHA256 {
+			return reextract
+		}
+	}
+
+	return refetch
+}
+
+// stamp is what the extraction stamp of a package should contain: the archive hash, commit or local fingerprint depending on where it came from
+func (p *Package) stamp() string {
+	switch p.SourceType {
+	case pathSource:
+		if p.PathMode == copyPath {
+			return p.Fingerprint
+		}
+		return ""
+	case gitSource:
+		return p.Commit
+	}
+
+	return p.ArchiveSHA256
+}
+
+func writeStamp(directory, value string) error {
+	if len(value) == 0 {
+		return nil
+	}
+
+	return ioutil.WriteFile(filepath.Join(directory, extractionStamp), []byte(value), 0600)
+}
+
+func readStamp(directory string) string {
+	b, err := ioutil.ReadFile(filepath.Join(directory, extractionStamp))
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(b))
+}
+
+// removeIncompleteSources cleans up temporary trees left behind by an extraction or clone that was interrupted, and old
+// trees that were renamed aside to be replaced but never deleted
+func removeIncompleteSources() {
+	for _, pattern := range []string{".*-extract-*", ".*-clone-*", ".*-old-*"} {
+		matches, _ := filepath.Glob(filepath.Join("source", pattern))
+		for _, match := range matches {
+			fmt.Printf("Removing incomplete source %s\n", match)
+			os.RemoveAll(match)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCachedSourceCheck(t *testing.T) {
+	inDirectory(t, t.TempDir())
+	if err := os.Mkdir("source", 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := filepath.Join("source", "zlib-v1.3.1.tar.gz")
+	if err := ioutil.WriteFile(archive, []byte("archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256Hex("archive")
+
+	tree := filepath.Join("source", "zlib-v1.3.1-51b7f2a")
+	if err := os.Mkdir(tree, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeStamp(tree, sum); err != nil {
+		t.Fatal(err)
+	}
+
+	cached := cachedSource{Source: tree, Archive: archive, SHA256: sum, Stamp: sum, Tag: "v1.3.1"}
+
+	steps := []struct {
+		name   string
+		damage func()
+		fresh  bool
+		want   sourceAction
+	}{
+		{"intact", func() {}, false, useCached},
+		{"fresh", func() {}, true, reextract},
+		{"old cache without a stamp", func() { cached.Stamp = "" }, false, useCached},
+		{"stamp doesnt match", func() {
+			cached.Stamp = sum
+			writeStamp(tree, "something else")
+		}, false, reextract},
+		{"tree is gone", func() { os.RemoveAll(tree) }, false, reextract},
+		{"archive is corrupt too", func() { ioutil.WriteFile(archive, []byte("truncated"), 0644) }, false, refetch},
+		{"archive is gone", func() { os.Remove(archive) }, false, refetch},
+		{"nothing recorded about the archive", func() { cached.Archive, cached.SHA256 = "", "" }, false, refetch},
+	}
+
+	for _, step := range steps {
+		step.damage()
+		if got := cached.check(step.fresh); got != step.want {
+			t.Errorf("%s: action %d, want %d", step.name, got, step.want)
+		}
+	}
+
+	// The archive only matters once the tree cant be used
+	if err := os.Mkdir(tree, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeStamp(tree, sum); err != nil {
+		t.Fatal(err)
+	}
+	cached = cachedSource{Source: tree, Archive: archive, SHA256: sum, Stamp: sum}
+	if got := cached.check(false); got != useCached {
+		t.Errorf("A good tree should be used even though its archive is gone, got action %d", got)
+	}
+}
+
+func TestRemoveIncompleteSources(t *testing.T) {
+	inDirectory(t, t.TempDir())
+
+	leftovers := []string{".zlib-extract-123", ".zlib-clone-456", ".zlib-v1.3.1-51b7f2a-old-789"}
+	kept := []string{"zlib-v1.3.1-51b7f2a", "old-zlib"}
+
+	for _, name := range append(append([]string{}, leftovers...), kept...) {
+		if err := os.MkdirAll(filepath.Join("source", name, "src"), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removeIncompleteSources()
+
+	for _, name := range leftovers {
+		if Exists(filepath.Join("source", name)) {
+			t.Errorf("%s should have been removed", name)
+		}
+	}
+	for _, name := range kept {
+		if !Exists(filepath.Join("source", name)) {
+			t.Errorf("%s should have been kept", name)
+		}
+	}
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// manifestProblem is something wrong with part of a pkg file, path is where it is (e.g packages[2].depends[0])
+type manifestProblem struct {
+	path    string
+	offset  int // Byte offset into the file, -1 if it isnt known
+	message string
+	warning bool
+	in      *manifestIndex // File the problem is in when it was included, otherwise the one being read
+}
+
+// manifestIndex knows where each value in a pkg file starts, so problems can be reported with a line and column
+type manifestIndex struct {
+	file      string
+	contents  []byte
+	positions map[string]int            // Path -> byte offset, object members point at their key
+	origins   map[string]manifestOrigin // Path -> where it came from, for values merged in from included files
+}
+
+// position finds the offset of a path, or of the closest thing containing it (so a missing field points at its package)
+func (idx manifestIndex) position(path string) int {
+	for {
+		if offset, ok := idx.positions[path]; ok {
+			return offset
+		}
+
+		i := strings.LastIndexAny(path, ".[")
+		if i == -1 {
+			return -1
+		}
+		path = path[:i]
+	}
+}
+
+// locate finds which file a path is in and where, following it into included files
+func (idx manifestIndex) locate(path string) (in *manifestIndex, offset int) {
+	for p := path; len(idx.origins) != 0; {
+		if origin, ok := idx.origins[p]; ok {
+			rest := path[len(p):]
+			if len(origin.path) == 0 {
+				rest = strings.TrimPrefix(rest, ".")
+			}
+			return origin.index, origin.index.position(origin.path + rest)
+		}
+
+		i := strings.LastIndexAny(p, ".[")
+		if i == -1 {
+			break
+		}
+		p = p[:i]
+	}
+	return nil, idx.position(path)
+}
+
+// has is whether a path is set, in the file or in one it includes
+func (idx manifestIndex) has(path string) bool {
+	_, inFile := idx.positions[path]
+	_, included := idx.origins[path]
+	return inFile || included
+}
+
+func (idx manifestIndex) problem(warning bool, path, format string, args ...interface{}) manifestProblem {
+	in, offset := idx.locate(path)
+	return manifestProblem{path: path, offset: offset, message: fmt.Sprintf(format, args...), warning: warning, in: in}
+}
+
+// at finds the innermost value that starts before offset, which is where encoding/json has got to when it reports an error
+func (idx manifestIndex) at(offset int) (path string, start int) {
+	start = -1
+	for p, o := range idx.positions {
+		if o < offset && (o > start || o == start && len(p) > len(path)) {
+			path, start = p, o
+		}
+	}
+	return path, start
+}
+
+// lineColumn turns a byte offset into a line and column, both starting at 1
+func (idx manifestIndex) lineColumn(offset int) (line, column int) {
+	if offset > len(idx.contents) {
+		offset = len(idx.contents)
+	}
+
+	before := idx.contents[:offset]
+	line = bytes.Count(before, []byte("\n")) + 1
+	column = utf8.RuneCount(before[bytes.LastIndexByte(before, '\n')+1:]) + 1
+
+	return line, column
+}
+
+func (idx manifestIndex) format(p manifestProblem) string {
+	if p.in != nil {
+		idx = *p.in
+	}
+
+	location := idx.file
+	if p.offset >= 0 {
+		line, column := idx.lineColumn(p.offset)
+		location = fmt.Sprintf("%s:%d:%d", idx.file, line, column)
+	}
+
+	kind := "error"
+	if p.warning {
+		kind = "warning"
+	}
+
+	if len(p.path) == 0 {
+		return fmt.Sprintf("%s: %s: %s", location, kind, p.message)
+	}
+	return fmt.Sprintf("%s: %s: %s: %s", location, kind, p.path, p.message)
+}
+
+// indexManifest walks the pkg file recording where everything is, and checks each key is a field of what it is decoded into
+// Anything that isnt valid json is returned as an error, as nothing after it can be trusted
+func indexManifest(file string, contents []byte, into reflect.Type) (idx manifestIndex, problems []manifestProblem, err error) {
+	idx = manifestIndex{file: file, contents: contents, positions: make(map[string]int)}
+
+	w := manifestWalker{decoder: json.NewDecoder(bytes.NewReader(contents)), idx: &idx}
+	err = w.value("", into)
+	if err == nil {
+		offset := w.start()
+		if _, extra := w.decoder.Token(); extra != io.EOF {
+			return idx, nil, idx.errorOf([]manifestProblem{{offset: offset, message: "Unexpected data after the end of the pkg file"}})
+		}
+	}
+
+	if err != nil {
+		offset := int(w.decoder.InputOffset())
+
+		// Offset is how much was read, including the character that was wrong
+		var syntax *json.SyntaxError
+		if errors.As(err, &syntax) {
+			offset = int(syntax.Offset)
+			if offset > 0 {
+				offset--
+			}
+		}
+
+		return idx, nil, idx.errorOf([]manifestProblem{{offset: offset, message: strings.TrimPrefix(err.Error(), "json: ")}})
+	}
+
+	return idx, w.problems, nil
+}
+
+type manifestWalker struct {
+	decoder  *json.Decoder
+	idx      *manifestIndex
+	problems []manifestProblem
+}
+
+// start is where the next token begins, skipping the whitespace, commas and colons before it
+func (w *manifestWalker) start() int {
+	offset := int(w.decoder.InputOffset())
+	for offset < len(w.idx.contents) && strings.IndexByte(" \t\r\n,:", w.idx.contents[offset]) != -1 {
+		offset++
+	}
+	return offset
+}
+
+// value reads the value at path, t is what it will be decoded into or nil if anything goes
+func (w *manifestWalker) value(path string, t reflect.Type) error {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if _, ok := w.idx.positions[path]; !ok {
+		w.idx.positions[path] = w.start()
+	}
+
+	token, err := w.decoder.Token()
+	if err != nil {
+		return err
+	}
+
+	switch token {
+	case json.Delim('{'):
+		return w.object(path, t)
+	case json.Delim('['):
+		var elem reflect.Type
+		if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+			elem = t.Elem()
+		}
+
+		for i := 0; w.decoder.More(); i++ {
+			if err := w.value(fmt.Sprintf("%s[%d]", path, i), elem); err != nil {
+				return err
+			}
+		}
+		_, err = w.decoder.Token()
+		return err
+	}
+
+	return nil
+}
+
+func (w *manifestWalker) object(path string, t reflect.Type) error {
+	var fields map[string]reflect.Type
+	var elem reflect.Type
+	if t != nil {
+		switch t.Kind() {
+		case reflect.Struct:
+			fields = jsonFields(t)
+		case reflect.Map:
+			elem = t.Elem()
+		}
+	}
+
+	for w.decoder.More() {
+		offset := w.start()
+
+		token, err := w.decoder.Token()
+		if err != nil {
+			return err
+		}
+		key := token.(string)
+
+		child := key
+		if len(path) != 0 {
+			child = path + "." + key
+		}
+		w.idx.positions[child] = offset
+
+		childType := elem
+		if fields != nil {
+			var known bool
+			childType, known = fields[strings.ToLower(key)]
+			if !known {
+				w.problems = append(w.problems, manifestProblem{path: child, offset: offset, message: unknownField(key, fields)})
+			}
+		}
+
+		if err := w.value(child, childType); err != nil {
+			return err
+		}
+	}
+
+	_, err := w.decoder.Token()
+	return err
+}
+
+// jsonFields lists the keys encoding/json would accept for a struct (lower cased, as it matches them case insensitively)
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		// Embedded structs have their fields promoted, like githubEndpoints
+		if f.Anonymous && f.Type.Kind() == reflect.Struct && len(tag) == 0 {
+			for name, fieldType := range jsonFields(f.Type) {
+				fields[name] = fieldType
+			}
+			continue
+		}
+
+		if !f.IsExported() {
+			continue
+		}
+
+		name := strings.Split(tag, ",")[0]
+		if len(name) == 0 {
+			name = f.Name
+		}
+		fields[strings.ToLower(name)] = f.Type
+	}
+
+	return fields
+}
+
+// unknownField describes a key that isnt a field, suggesting the one that was probably meant
+func unknownField(key string, fields map[string]reflect.Type) string {
+	names := []string{}
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	best, bestDistance := "", 3
+	for _, name := range names {
+		if d := editDistance(strings.ToLower(key), name); d < bestDistance {
+			best, bestDistance = name, d
+		}
+	}
+
+	if len(best) != 0 {
+		return fmt.Sprintf("unknown field \"%s\", did you mean \"%s\"?", key, best)
+	}
+	return fmt.Sprintf("unknown field \"%s\"", key)
+}
+
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+
+	return previous[len(b)]
+}
+
+// decodeManifest decodes a pkg file strictly, any keys that arent part of the format or values of the wrong type are problems
+// reported with where they are in the file. What can be decoded still is, so everything else can be checked too
+// err is set if the file isnt valid json at all
+func decodeManifest(file string, contents []byte) (settings pkgManifest, idx manifestIndex, problems []manifestProblem, err error) {
+	idx, problems, err = decodeDocument(file, contents, &settings)
+	return settings, idx, problems, err
+}
+
+// decodeDocument is decodeManifest for anything, into points at what to decode into (like a package on its own)
+func decodeDocument(file string, contents []byte, into interface{}) (idx manifestIndex, problems []manifestProblem, err error) {
+	// Yaml and toml are decoded as the json they convert to, with problems reported at where they are in the original
+	var source *manifestIndex
+	if format := manifestFormat(file, contents); format != jsonFormat {
+		doc, positions, err := parseManifest(file, contents, format, reflect.TypeOf(into).Elem())
+		if err != nil {
+			return idx, nil, err
+		}
+
+		source = &manifestIndex{file: file, contents: contents, positions: positions}
+		contents, err = marshalDocument(doc, jsonFormat)
+		if err != nil {
+			return idx, nil, err
+		}
+
+		defer func() {
+			for i := range problems {
+				problems[i].offset = source.position(problems[i].path)
+			}
+			idx = *source
+		}()
+	}
+
+	idx, problems, err = indexManifest(file, contents, reflect.TypeOf(into).Elem())
+	if err != nil {
+		return idx, nil, err
+	}
+
+	// Unknown fields have already been found with their positions, decoding without caring about them finds the first
+	// value of the wrong type rather than stopping at the first unknown field
+	err = json.Unmarshal(contents, into)
+	if err == nil && len(problems) == 0 {
+		decoder := json.NewDecoder(bytes.NewReader(contents))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(reflect.New(reflect.TypeOf(into).Elem()).Interface())
+	}
+
+	var typeError *json.UnmarshalTypeError
+	switch {
+	case err == nil:
+	case errors.As(err, &typeError):
+		path, offset := idx.at(int(typeError.Offset))
+		problems = append(problems, manifestProblem{
+			path:    path,
+			offset:  offset,
+			message: fmt.Sprintf("should be %s, not %s", describeType(typeError.Type), typeError.Value),
+		})
+	default:
+		problems = append(problems, manifestProblem{offset: -1, message: strings.TrimPrefix(err.Error(), "json: ")})
+	}
+
+	return idx, problems, nil
+}
+
+func (idx manifestIndex) errorOf(problems []manifestProblem) error {
+	lines := []string{}
+	for _, p := range problems {
+		lines = append(lines, idx.format(p))
+	}
+
+	return errors.New(strings.Join(lines, "\n"))
+}
+
+func describeType(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array:
+		return "a list"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.String:
+		return "a string"
+	}
+	return "a number"
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProblemPositions(t *testing.T) {
+	tests := []struct {
+		file     string
+		contents string
+		want     []string // Every problem, or the error if the file cant be decoded at all
+	}{
+		{
+			"unknown.json",
+			"{\n  \"packages\": [\n    {\n      \"name\": \"zlib\",\n      \"rpeo\": \"madler/zlib\"\n    }\n  ]\n}\n",
+			[]string{`unknown.json:5:7: error: packages[0].rpeo: unknown field "rpeo", did you mean "repo"?`},
+		},
+		{
+			// Columns count characters rather than bytes
+			"type.json",
+			`{"packages": [{"name": "zlïb", "strip_components": "1"}]}`,
+			[]string{"type.json:1:32: error: packages[0].strip_components: should be a number, not string"},
+		},
+		{
+			"syntax.json",
+			"{\n  \"packages\": [\n    {\"name\": \"zlib\" \"repo\": \"x\"}\n  ]\n}\n",
+			[]string{`syntax.json:3:21: error: invalid character '"' after object key:value pair`},
+		},
+		{
+			"element.json",
+			`{"packages": [1 2]}`,
+			[]string{"element.json:1:17: error: invalid character '2' after array element"},
+		},
+		{
+			"trailing.json",
+			"{\"packages\": []}\n{}",
+			[]string{"trailing.json:2:1: error: Unexpected data after the end of the pkg file"},
+		},
+		{
+			"unknown.yaml",
+			"packages:\n  - name: zlib\n    depends: openssl\n    biuld: make\n",
+			[]string{
+				`unknown.yaml:4:5: error: packages[0].biuld: unknown field "biuld", did you mean "build"?`,
+				"unknown.yaml:3:5: error: packages[0].depends: should be a list, not string",
+			},
+		},
+		{
+			"type.yaml",
+			"packages:\n  - name: zlib\n    strip_components: [1]\n",
+			[]string{"type.yaml:3:5: error: packages[0].strip_components: should be a number, not array"},
+		},
+		{
+			// Only the second package has the key, so that is where it has to be found
+			"unknown.toml",
+			"[[packages]]\nname = \"zlib\"\n\n[[packages]]\nname = \"openssl\"\nrpeo = \"openssl/openssl\"\n",
+			[]string{`unknown.toml:6:1: error: packages[1].rpeo: unknown field "rpeo", did you mean "repo"?`},
+		},
+		{
+			"type.toml",
+			"[[packages]]\nname = \"zlib\"\nstrip_components = \"one\"\n",
+			[]string{"type.toml:3:1: error: packages[0].strip_components: should be a number, not string"},
+		},
+		{
+			"syntax.toml",
+			"[[packages]]\nname = zlib\n",
+			[]string{`syntax.toml:2:8: expected value but found "zlib" instead`},
+		},
+	}
+
+	for _, test := range tests {
+		_, idx, problems, err := decodeManifest(test.file, []byte(test.contents))
+
+		var got []string
+		switch {
+		case err != nil:
+			got = strings.Split(err.Error(), "\n")
+		case len(problems) != 0:
+			got = strings.Split(idx.errorOf(problems).Error(), "\n")
+		}
+
+		if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("%s reported:\n%s\nwant:\n%s", test.file, strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+		}
+	}
+}
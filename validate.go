@@ -0,0 +1,204 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+// validate checks a pkg file without fetching or building anything, reporting every problem it finds with where it is
+func validate(args []string) error {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: validate <pkg file>")
+	}
+
+	settings, idx, problems, err := readManifest(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	problems = append(problems, checkManifest(settings, idx)...)
+
+	// Then whatever the loader itself would refuse, it stops at the first problem so there is only ever one of these
+	if err := settings.prepare(); err != nil {
+		problems = append(problems, loaderProblem(settings, idx, err))
+	}
+
+	// Problems in the pkg file first, then those in the files it includes
+	file := func(p manifestProblem) string {
+		if p.in == nil || p.in.file == idx.file {
+			return ""
+		}
+		return p.in.file
+	}
+	sort.SliceStable(problems, func(i, j int) bool {
+		if file(problems[i]) != file(problems[j]) {
+			return file(problems[i]) < file(problems[j])
+		}
+		return problems[i].offset < problems[j].offset
+	})
+
+	errorCount, warningCount := 0, 0
+	for _, p := range problems {
+		fmt.Println(idx.format(p))
+		if p.warning {
+			warningCount++
+		} else {
+			errorCount++
+		}
+	}
+
+	if errorCount != 0 {
+		return fmt.Errorf("%s has %d error(s) and %d warning(s)", flags.Arg(0), errorCount, warningCount)
+	}
+
+	fmt.Printf("%s is valid (%d warning(s))\n", flags.Arg(0), warningCount)
+	return nil
+}
+
+var loaderPackageError = regexp.MustCompile(`^Package \[([^\]]*)\]`)
+
+// loaderProblem places an error from the loader at the package it mentions, if it mentions one
+func loaderProblem(settings pkgManifest, idx manifestIndex, err error) manifestProblem {
+	if m := loaderPackageError.FindStringSubmatch(err.Error()); m != nil {
+		for i, pkg := range settings.Packages {
+			if pkg.Name == m[1] {
+				return idx.problem(false, fmt.Sprintf("packages[%d]", i), "%s", err)
+			}
+		}
+	}
+
+	return manifestProblem{offset: -1, message: err.Error()}
+}
+
+// checkManifest finds problems the loader doesnt care about, but which would fail a build part way through
+func checkManifest(settings pkgManifest, idx manifestIndex) (problems []manifestProblem) {
+	report := func(warning bool, path, format string, args ...interface{}) {
+		problems = append(problems, idx.problem(warning, path, format, args...))
+	}
+
+	if len(settings.Packages) == 0 {
+		report(false, "packages", "no packages")
+	}
+
+	names := make(map[string]int)
+	for i, pkg := range settings.Packages {
+		if pkg == nil {
+			continue
+		}
+		if len(pkg.Name) == 0 {
+			report(false, fmt.Sprintf("packages[%d]", i), "package has no name")
+			continue
+		}
+
+		if first, ok := names[pkg.Name]; ok {
+			report(false, fmt.Sprintf("packages[%d].name", i), "duplicate package name '%s', packages[%d] is already called that", pkg.Name, first)
+			continue
+		}
+		names[pkg.Name] = i
+	}
+
+	for i, pkg := range settings.Packages {
+		if pkg == nil {
+			report(false, fmt.Sprintf("packages[%d]", i), "package is null")
+			continue
+		}
+		at := func(field string) string {
+			return fmt.Sprintf("packages[%d].%s", i, field)
+		}
+
+		isPath := pkg.SourceType == pathSource || len(pkg.SourceType) == 0 && (len(pkg.Path) != 0 || len(pkg.Source) != 0)
+		if !isPath && len(pkg.Repository) == 0 {
+			report(false, at("repo"), "package [%s] has no repo", pkg.Name)
+		}
+
+		for j, dependency := range pkg.Depends {
+			if dependency == pkg.Name {
+				report(false, fmt.Sprintf("%s[%d]", at("depends"), j), "package [%s] depends on itself", pkg.Name)
+			} else if _, ok := names[dependency]; !ok {
+				report(false, fmt.Sprintf("%s[%d]", at("depends"), j), "package [%s] depends on '%s', which isnt a package", pkg.Name, dependency)
+			}
+		}
+
+		if len(pkg.ValidTagRegex) != 0 {
+			if _, err := regexp.Compile(pkg.ValidTagRegex); err != nil {
+				report(false, at("tag_regex"), "%s", err)
+			}
+		}
+
+		if len(pkg.ReleaseAsset) != 0 {
+			if _, err := path.Match(pkg.ReleaseAsset, ""); err != nil {
+				report(false, at("release_asset"), "pattern '%s' is invalid: %s", pkg.ReleaseAsset, err)
+			}
+		}
+
+		if len(pkg.Patches) != 0 && !directoryExists(pkg.Patches) {
+			report(false, at("patches"), "patches directory %s doesnt exist", pkg.Patches)
+		}
+
+		regexes := []string{}
+		for regex := range pkg.PatchSets {
+			regexes = append(regexes, regex)
+		}
+		sort.Strings(regexes)
+
+		for _, regex := range regexes {
+			if _, err := regexp.Compile(regex); err != nil {
+				report(false, at("patch_sets."+regex), "%s", err)
+			}
+			if !directoryExists(pkg.PatchSets[regex]) {
+				report(false, at("patch_sets."+regex), "patches directory %s doesnt exist", pkg.PatchSets[regex])
+			}
+		}
+	}
+
+	problems = append(problems, checkImageSettings(settings.ImageSettings, idx)...)
+
+	return problems
+}
+
+// checkImageSettings makes sure there is enough to create the image with, which happens by default after building
+func checkImageSettings(image Image, idx manifestIndex) (problems []manifestProblem) {
+	report := func(warning bool, path, format string, args ...interface{}) {
+		problems = append(problems, idx.problem(warning, path, format, args...))
+	}
+
+	if !idx.has("image_settings") {
+		report(true, "", "no image_settings, so creating the image will fail (use -configure or -build to skip it)")
+		return problems
+	}
+
+	if len(image.Filename) == 0 {
+		report(false, "image_settings.image_name", "image_settings has no image_name")
+	}
+
+	if len(image.KeyExecutables) == 0 {
+		report(false, "image_settings.executables", "image_settings has no executables")
+	}
+
+	for i, executable := range image.KeyExecutables {
+		if _, err := filepath.Match(executable, ""); err != nil {
+			report(false, fmt.Sprintf("image_settings.executables[%d]", i), "pattern '%s' is invalid: %s", executable, err)
+		}
+	}
+
+	if len(image.CrossCompilerLibRoot) == 0 {
+		report(false, "image_settings.cross_compiler_lib_root", "image_settings has no cross_compiler_lib_root")
+	} else if _, err := os.Stat(image.CrossCompilerLibRoot); err != nil {
+		// Depends on the machine, so only a warning
+		report(true, "image_settings.cross_compiler_lib_root", "%s doesnt exist on this machine", image.CrossCompilerLibRoot)
+	}
+
+	if len(image.Configuration) != 0 && !directoryExists(image.Configuration) {
+		report(false, "image_settings.image_config", "image_config directory %s doesnt exist", image.Configuration)
+	}
+
+	return problems
+}
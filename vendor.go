@@ -0,0 +1,203 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// A vendor directory holds the archives of every package named by their sha256 in objects/, bundles of the mirrors of
+// git sources in git/, and the lock file they were resolved from, so it can be copied to a machine without network
+// access and used with -vendor
+const vendorLockFile = "vendor.lock"
+
+// vendoredBundle is where a bundle of a repositorys mirror goes, named like the mirror in cache/git
+func vendoredBundle(vendorDirectory, repository string) string {
+	if len(vendorDirectory) == 0 {
+		return ""
+	}
+
+	return filepath.Join(vendorDirectory, "git", mirrorName(repository)+".bundle")
+}
+
+func vendoredArchive(vendorDirectory, digest string) string {
+	if len(vendorDirectory) == 0 || len(digest) == 0 {
+		return ""
+	}
+
+	return filepath.Join(vendorDirectory, "objects", digest)
+}
+
+// findArchive returns the first of the candidate paths that holds an archive with the given sha256
+func findArchive(digest string, candidates ...string) (string, bool) {
+	if len(digest) == 0 {
+		return "", false
+	}
+
+	for _, candidate := range candidates {
+		if len(candidate) == 0 {
+			continue
+		}
+
+		if sum, err := fileSHA256(candidate); err == nil && sum == digest {
+			path, err := filepath.Abs(candidate)
+			return path, err == nil
+		}
+	}
+
+	return "", false
+}
+
+// vendor copies the archive of every package (or bundle of its mirror, for git sources) into a directory along with the
+// lock file, resolving and downloading anything that isnt locked or cached yet
+func vendor(args []string) error {
+	flags := flag.NewFlagSet("vendor", flag.ExitOnError)
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		return fmt.Errorf("Usage: vendor <pkg file> <directory>")
+	}
+
+	settings, err := loadPackageManifest(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	lockPath := lockFilePath(flags.Arg(0))
+	lock, err := loadLockFile(lockPath)
+	if err != nil {
+		return err
+	}
+
+	cachedPackageSources, err := loadSourceCache()
+	if err != nil {
+		return err
+	}
+
+	for _, directory := range []string{"source", "cache", filepath.Join(flags.Arg(1), "objects"), filepath.Join(flags.Arg(1), "git")} {
+		if err := os.MkdirAll(directory, 0700); err != nil {
+			return err
+		}
+	}
+
+	sort.Slice(settings.Packages, func(i, j int) bool {
+		return settings.Packages[i].Name < settings.Packages[j].Name
+	})
+
+	vendored := make(lockFile)
+	bundles := make(map[string]bool)
+	for _, pkg := range settings.Packages {
+		if pkg.SourceType == pathSource {
+			fmt.Printf("%s: local source, not vendored\n", pkg.Name)
+			continue
+		}
+
+		// Git sources are locked to a commit, everything else to an archive
+		locked, isLocked := lock[pkg.Name]
+		if isLocked && (!pkg.satisfiedBy(locked.Tag, locked.Commit) || len(locked.SHA256) == 0 && pkg.SourceType != gitSource) {
+			isLocked = false
+		}
+
+		var archive string
+		found := false
+		if isLocked && (!pkg.Signature.enabled() || pkg.Signature.signedByCurrentKey(locked.SignedBy)) {
+			if pkg.SourceType == gitSource {
+				m, err := openGitMirror(pkg.Repository, false)
+				found = err == nil && m.has(locked.Commit)
+			} else {
+				archive, found = findArchive(locked.SHA256, cachedPackageSources[pkg.Name].Archive, objectPath(locked.SHA256))
+			}
+		}
+
+		if !found {
+			if isLocked {
+				pkg.Tag, pkg.Commit = locked.Tag, locked.Commit
+				pkg.ArchiveSHA256, pkg.ArchiveURL = locked.SHA256, locked.URL
+			} else {
+				pkg.Tag, pkg.Commit, err = resolve(*pkg)
+				if err != nil {
+					return err
+				}
+			}
+
+			fmt.Printf("[Missing %s] Downloading %s %s...", pkg.Name, pkg.Repository, pkg.Tag)
+			fetched, err := fetch(*pkg)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Done!\n")
+
+			if isLocked && fetched.SHA256 != locked.SHA256 {
+				return fmt.Errorf("Archive for %s does not match the lock file, expected sha256 %s got %s", pkg.Name, locked.SHA256, fetched.SHA256)
+			}
+
+			archive, locked = fetched.Path, fetched.lockedPackage
+			lock[pkg.Name] = locked
+		}
+
+		vendored[pkg.Name] = locked
+
+		if pkg.SourceType == gitSource {
+			m, err := openGitMirror(pkg.Repository, false)
+			if err != nil {
+				return err
+			}
+
+			written, err := m.bundle(locked.Commit, flags.Arg(1))
+			if err != nil {
+				return fmt.Errorf("Package [%s] %s", pkg.Name, err)
+			}
+			for _, bundle := range written {
+				bundles[filepath.Base(bundle)] = true
+			}
+
+			fmt.Printf("%s: %s (%s) %d bundle(s)\n", pkg.Name, locked.Tag, shortCommit(locked.Commit), len(written))
+			continue
+		}
+
+		err = Copy(archive, vendoredArchive(flags.Arg(1), locked.SHA256))
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s: %s (%s) %s\n", pkg.Name, locked.Tag, shortCommit(locked.Commit), locked.SHA256)
+	}
+
+	// Drop archives left over from packages that have since been updated or removed
+	objects, err := ioutil.ReadDir(filepath.Join(flags.Arg(1), "objects"))
+	if err != nil {
+		return err
+	}
+
+	inUse := make(map[string]bool)
+	for _, locked := range vendored {
+		inUse[locked.SHA256] = true
+	}
+
+	for _, object := range objects {
+		if !inUse[object.Name()] {
+			os.Remove(filepath.Join(flags.Arg(1), "objects", object.Name()))
+		}
+	}
+
+	existing, err := ioutil.ReadDir(filepath.Join(flags.Arg(1), "git"))
+	if err != nil {
+		return err
+	}
+
+	for _, bundle := range existing {
+		if !bundles[bundle.Name()] {
+			os.Remove(filepath.Join(flags.Arg(1), "git", bundle.Name()))
+		}
+	}
+
+	err = vendored.write(filepath.Join(flags.Arg(1), vendorLockFile))
+	if err != nil {
+		return err
+	}
+
+	return lock.write(lockPath)
+}
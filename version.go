@@ -0,0 +1,309 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Version is a release tag reduced to something comparable. Projects spell their tags in all sorts of ways
+// (v1.2.3, OpenSSL_1_1_1k, V_9_3_P1, 3.0.0-alpha1) so anything before the first digit is treated as a prefix and thrown away.
+type Version struct {
+	Tag   string
+	Parts []int
+
+	// Pre releases (alpha, beta, rc) sort before the release they lead up to
+	PreRank int
+	PreNum  int
+}
+
+var preReleaseRanks = map[string]int{
+	"dev":   1,
+	"a":     2,
+	"alpha": 2,
+	"b":     3,
+	"beta":  3,
+	"pre":   4,
+	"rc":    5,
+}
+
+func parseVersion(tag string) (v Version, ok bool) {
+	v.Tag = tag
+
+	start := strings.IndexFunc(tag, unicode.IsDigit)
+	if start == -1 {
+		return v, false
+	}
+
+	rest := tag[start:]
+	if i := strings.Index(rest, "+"); i != -1 { // Build metadata doesnt take part in ordering
+		rest = rest[:i]
+	}
+
+	tokens := splitVersionTokens(rest)
+
+	inPre := false
+	appendNext := false
+	for i, token := range tokens {
+		if n, err := strconv.Atoi(token); err == nil {
+			if inPre {
+				v.PreNum = n
+				continue
+			}
+			v.Parts = append(v.Parts, n)
+			appendNext = false
+			continue
+		}
+
+		word := strings.ToLower(token)
+
+		if rank, ok := preReleaseRanks[word]; ok && (len(word) > 1 || i+1 < len(tokens)) {
+			v.PreRank = rank
+			inPre = true
+			continue
+		}
+
+		switch {
+		case word == "p" || word == "pl" || word == "patch":
+			// openssh style portable releases, V_9_3_P1 is 9.3.1
+			appendNext = true
+		case len(word) == 1 && !inPre:
+			// openssl style letter releases, 1.1.1k comes after 1.1.1j
+			v.Parts = append(v.Parts, int(word[0]-'a')+1)
+		}
+	}
+
+	if appendNext {
+		v.Parts = append(v.Parts, 0)
+	}
+
+	return v, len(v.Parts) > 0
+}
+
+// splitVersionTokens breaks a version into runs of digits and runs of letters, dropping any separators
+func splitVersionTokens(s string) (tokens []string) {
+	current := strings.Builder{}
+	currentDigit := false
+
+	flush := func() {
+		if current.Len() > 0 {
+			tokens = append(tokens, current.String())
+			current.Reset()
+		}
+	}
+
+	for _, r := range s {
+		switch {
+		case unicode.IsDigit(r):
+			if !currentDigit {
+				flush()
+			}
+			currentDigit = true
+			current.WriteRune(r)
+		case unicode.IsLetter(r):
+			if currentDigit {
+				flush()
+			}
+			currentDigit = false
+			current.WriteRune(r)
+		default:
+			flush()
+		}
+	}
+	flush()
+
+	return tokens
+}
+
+// Compare returns -1, 0 or 1 if v is older, the same as or newer than other
+func (v Version) Compare(other Version) int {
+	length := len(v.Parts)
+	if len(other.Parts) > length {
+		length = len(other.Parts)
+	}
+
+	for i := 0; i < length; i++ {
+		a, b := 0, 0
+		if i < len(v.Parts) {
+			a = v.Parts[i]
+		}
+		if i < len(other.Parts) {
+			b = other.Parts[i]
+		}
+
+		if a != b {
+			if a < b {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	switch {
+	case v.PreRank == other.PreRank && v.PreNum == other.PreNum:
+		return 0
+	case v.PreRank == 0:
+		return 1
+	case other.PreRank == 0:
+		return -1
+	case v.PreRank < other.PreRank, v.PreRank == other.PreRank && v.PreNum < other.PreNum:
+		return -1
+	}
+
+	return 1
+}
+
+func (v Version) String() string {
+	parts := make([]string, len(v.Parts))
+	for i := range v.Parts {
+		parts[i] = strconv.Itoa(v.Parts[i])
+	}
+
+	s := strings.Join(parts, ".")
+	if v.PreRank != 0 {
+		for name, rank := range preReleaseRanks {
+			if rank == v.PreRank && len(name) > 1 {
+				s += "-" + name + strconv.Itoa(v.PreNum)
+				break
+			}
+		}
+	}
+
+	return s
+}
+
+type versionComparison struct {
+	op      string
+	version Version
+}
+
+func (c versionComparison) matches(v Version) bool {
+	r := v.Compare(c.version)
+	switch c.op {
+	case ">":
+		return r > 0
+	case ">=":
+		return r >= 0
+	case "<":
+		return r < 0
+	case "<=":
+		return r <= 0
+	case "!=":
+		return r != 0
+	}
+	return r == 0
+}
+
+// VersionConstraint is a set of alternatives (seperated by ||), each of which is a list of comparisons that must all hold
+// e.g ">=1.2.11 <1.3 || >=2.0"
+type VersionConstraint struct {
+	raw          string
+	alternatives [][]versionComparison
+}
+
+var constraintOperators = []string{">=", "<=", "!=", "==", ">", "<", "="}
+
+func isVersionConstraint(s string) bool {
+	s = strings.TrimSpace(s)
+	for _, op := range constraintOperators {
+		if strings.HasPrefix(s, op) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseVersionConstraint(s string) (c VersionConstraint, err error) {
+	c.raw = s
+
+	for _, alternative := range strings.Split(s, "||") {
+		terms := strings.Fields(strings.ReplaceAll(alternative, ",", " "))
+
+		var comparisons []versionComparison
+		for i := 0; i < len(terms); i++ {
+			term := terms[i]
+
+			op := "="
+			for _, o := range constraintOperators {
+				if strings.HasPrefix(term, o) {
+					op = o
+					term = term[len(o):]
+					break
+				}
+			}
+
+			if term == "" { // Operator was seperated from its version by a space, ">= 1.2"
+				if i+1 >= len(terms) {
+					return c, fmt.Errorf("Version constraint '%s' has an operator with no version", s)
+				}
+				i++
+				term = terms[i]
+			}
+
+			v, ok := parseVersion(term)
+			if !ok {
+				return c, fmt.Errorf("Version constraint '%s' has an invalid version '%s'", s, term)
+			}
+
+			if op == "==" {
+				op = "="
+			}
+
+			comparisons = append(comparisons, versionComparison{op: op, version: v})
+		}
+
+		if len(comparisons) == 0 {
+			return c, fmt.Errorf("Version constraint '%s' is empty", s)
+		}
+
+		c.alternatives = append(c.alternatives, comparisons)
+	}
+
+	return c, nil
+}
+
+func (c VersionConstraint) Matches(v Version) bool {
+	for _, alternative := range c.alternatives {
+		all := true
+		for _, comparison := range alternative {
+			if !comparison.matches(v) {
+				all = false
+				break
+			}
+		}
+
+		if all {
+			return true
+		}
+	}
+	return false
+}
+
+// namesPreRelease checks whether any version in the constraint is a pre release, as asking for ">=3.0.0-beta1" means
+// pre releases are wanted
+func (c VersionConstraint) namesPreRelease() bool {
+	for _, alternative := range c.alternatives {
+		for _, comparison := range alternative {
+			if comparison.version.PreRank != 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// namesPreRelease checks whether s (a tag regex) mentions a pre release label like rc or beta
+func namesPreRelease(s string) bool {
+	for _, token := range splitVersionTokens(s) {
+		word := strings.ToLower(token)
+		if _, ok := preReleaseRanks[word]; ok && len(word) > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (c VersionConstraint) String() string {
+	return c.raw
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVersionOrdering(t *testing.T) {
+	// Each list is oldest first
+	orderings := [][]string{
+		{"v1.2.3", "v1.2.10", "v1.10.0", "v2"},
+		{"1.0-dev", "1.0-alpha", "1.0-beta2", "1.0-pre1", "1.0-rc1", "1.0-rc2", "1.0", "1.0.1"},
+		{"3.0.0-alpha1", "3.0.0-alpha2", "3.0.0-beta1", "3.0.0-rc1", "3.0.0"},
+		{"OpenSSL_1_0_2u", "OpenSSL_1_1_1", "OpenSSL_1_1_1j", "OpenSSL_1_1_1k", "openssl-3.0.0"},
+		{"V_9_2_P1", "V_9_3", "V_9_3_P1", "V_9_3_P2", "V_9_4"},
+		{"release-1.9", "release-1.10"},
+	}
+
+	for _, ordering := range orderings {
+		for i := range ordering {
+			for j := range ordering {
+				a, ok := parseVersion(ordering[i])
+				if !ok {
+					t.Fatalf("%s isnt a version", ordering[i])
+				}
+				b, _ := parseVersion(ordering[j])
+
+				want := 0
+				if i < j {
+					want = -1
+				} else if i > j {
+					want = 1
+				}
+
+				if got := a.Compare(b); got != want {
+					t.Errorf("%s compared to %s = %d, want %d", ordering[i], ordering[j], got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestVersionParsing(t *testing.T) {
+	tests := []struct {
+		tag   string
+		ok    bool
+		same  string // A tag that should compare equal, if any
+		print string
+	}{
+		{"v1.2.3", true, "1.2.3", "1.2.3"},
+		{"1.2", true, "1.2.0", "1.2"},
+		{"v1.2.3+build.5", true, "1.2.3", "1.2.3"},
+		{"3.0.0-beta2", true, "3.0.0.beta2", "3.0.0-beta2"},
+		{"OpenSSL_1_1_1k", true, "1.1.1.11", "1.1.1.11"},
+		{"V_9_3_P1", true, "9.3.1", "9.3.1"},
+		{"latest", false, "", ""},
+		{"", false, "", ""},
+	}
+
+	for _, test := range tests {
+		v, ok := parseVersion(test.tag)
+		if ok != test.ok {
+			t.Errorf("parseVersion(%s) ok = %v, want %v", test.tag, ok, test.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		if same, _ := parseVersion(test.same); v.Compare(same) != 0 {
+			t.Errorf("%s should be the same version as %s", test.tag, test.same)
+		}
+		if v.String() != test.print {
+			t.Errorf("%s prints as %s, want %s", test.tag, v, test.print)
+		}
+	}
+}
+
+func TestVersionConstraint(t *testing.T) {
+	tests := []struct {
+		constraint string
+		matches    []string
+		rejects    []string
+	}{
+		// Pre releases come before the release, so <1.3 includes the 1.3 release candidates
+		{">=1.2.11 <1.3", []string{"1.2.11", "v1.2.13", "1.3.0-rc1"}, []string{"1.2.10", "1.3", "2.0"}},
+		{">= 1.2", []string{"1.2", "1.2.1", "3"}, []string{"1.1.9", "1.2-rc1"}},
+		{"<2 || >=3", []string{"1.0", "3.1"}, []string{"2", "2.5"}},
+		{"!=1.2.12, >=1.2", []string{"1.2", "1.2.13"}, []string{"1.2.12", "1.1"}},
+		{"==1.0", []string{"1.0", "1.0.0"}, []string{"1.0.1", "1.0-rc1"}},
+		{"=1.0", []string{"v1.0"}, []string{"1.1"}},
+		{">1.0", []string{"1.0.1"}, []string{"1.0", "1.0-rc1"}},
+		{"<=OpenSSL_1_1_1k", []string{"OpenSSL_1_1_1j", "1.1.1k"}, []string{"OpenSSL_1_1_1l"}},
+	}
+
+	for _, test := range tests {
+		if !isVersionConstraint(test.constraint) {
+			t.Errorf("%s should be a constraint", test.constraint)
+		}
+
+		c, err := parseVersionConstraint(test.constraint)
+		if err != nil {
+			t.Errorf("%s: %s", test.constraint, err)
+			continue
+		}
+
+		for _, tag := range test.matches {
+			if v, _ := parseVersion(tag); !c.Matches(v) {
+				t.Errorf("%s should match %s", test.constraint, tag)
+			}
+		}
+		for _, tag := range test.rejects {
+			if v, _ := parseVersion(tag); c.Matches(v) {
+				t.Errorf("%s shouldnt match %s", test.constraint, tag)
+			}
+		}
+	}
+
+	for _, version := range []string{"1.2.3", "v1.0", "main", "a1b2c3d"} {
+		if isVersionConstraint(version) {
+			t.Errorf("%s isnt a constraint, it should be looked up as a tag, branch or commit", version)
+		}
+	}
+
+	invalid := []struct {
+		constraint string
+		err        string
+	}{
+		{">=", "operator with no version"},
+		{">=abc", "invalid version"},
+		{">=1.0 ||", "is empty"},
+	}
+	for _, test := range invalid {
+		if _, err := parseVersionConstraint(test.constraint); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s should fail with %q, got %v", test.constraint, test.err, err)
+		}
+	}
+}
+
+func TestSelectTag(t *testing.T) {
+	tags := []remoteTag{}
+	for _, name := range []string{"v1.2.13", "v1.3.0-rc1", "v1.2.11", "nightly", "v1.3.1", "v2.0.0", "docs-1", "v2.1.0-rc2"} {
+		tags = append(tags, newRemoteTag(name, "commit-"+name))
+	}
+
+	tests := []struct {
+		constraint string
+		regex      string
+		want       string // Empty if nothing should match
+	}{
+		// v2.1.0-rc2 is the newest, but pre releases are only picked when the constraint or regex names one
+		{"", "", "v2.0.0"},
+		{">=1.2.11 <1.2.99", "", "v1.2.13"},
+		{">=1.2.11 <1.3", "", "v1.2.13"},
+		{"<1.3.1", "", "v1.2.13"},
+		{">=1.3.0-rc1 <1.3.1", "", "v1.3.0-rc1"},
+		{">=2.1.0-rc1", "", "v2.1.0-rc2"},
+		{"", `-rc[0-9]+$`, "v2.1.0-rc2"},
+		{"", `^v1\.`, "v1.3.1"},
+		{">=1.3", `^v1\.`, "v1.3.1"},
+		{"", "^nightly$", "nightly"},
+		{">=3", "", ""},
+		{">=2.1", "", ""},
+	}
+
+	for _, test := range tests {
+		var constraint *VersionConstraint
+		if len(test.constraint) != 0 {
+			c, err := parseVersionConstraint(test.constraint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			constraint = &c
+		}
+
+		tag, err := selectTag(tags, constraint, test.regex)
+		switch {
+		case len(test.want) == 0 && err == nil:
+			t.Errorf("%q %q should match nothing, got %s", test.constraint, test.regex, tag.Name)
+		case len(test.want) != 0 && (err != nil || tag.Name != test.want || tag.Commit != "commit-"+test.want):
+			t.Errorf("%q %q picked %s %s %v, want %s", test.constraint, test.regex, tag.Name, tag.Commit, err, test.want)
+		}
+	}
+}